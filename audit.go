@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Level of each workitem type in the backlog hierarchy. A child should be exactly one level
+// below its parent.
+var backlogLevels = map[string]int{
+	"Epic":                 0,
+	"Feature":              1,
+	"Product Backlog Item": 2,
+	"User Story":           2,
+	"Requirement":          2,
+	"Bug":                  2,
+	"Task":                 3,
+}
+
+// AuditIssue is a workitem that is not where it should be in the backlog
+type AuditIssue struct {
+	WorkItem WorkItem
+	Parent   WorkItem // zero for orphans
+	Problem  string
+}
+
+type AuditReport struct {
+	Orphans      []AuditIssue // active workitems with no epic above them
+	Misparented  []AuditIssue // parent is not exactly one level up, e.g. tasks directly under epics
+	Inconsistent []AuditIssue // child state does not agree with the parent state
+}
+
+// GetOrphans returns the active features, backlog items and tasks in the project that are
+// not under any epic
+func (r *AzureDevopsWit) GetOrphans() ([]WorkItem, error) {
+	underEpics := `
+	SELECT [System.Id]
+	FROM workitemLinks
+	WHERE
+		(
+			[Source].[System.TeamProject] = @project
+			AND [Source].[System.WorkItemType] = 'Epic'
+		)
+		AND (
+			[System.Links.LinkType] = 'System.LinkTypes.Hierarchy-Forward'
+		)
+		AND (
+			[Target].[System.TeamProject] = @project
+		)
+	MODE (Recursive)
+	`
+	res, err := r.runWiql(underEpics)
+	if err != nil {
+		return nil, err
+	}
+
+	inTree := make(map[int]bool)
+	for _, id := range res.Ids() {
+		inTree[id] = true
+	}
+
+	active := `
+	SELECT [System.Id]
+	FROM workitems
+	WHERE
+		[System.TeamProject] = @project
+		AND [System.WorkItemType] IN ('Feature', 'Product Backlog Item', 'User Story', 'Requirement', 'Bug', 'Task')
+		AND [System.State] NOT IN ` + bucketStates(StateDone)
+	res, err = r.runWiql(active)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []WorkItem
+	for _, id := range res.Ids() {
+		if inTree[id] {
+			continue
+		}
+
+		wi, err := r.GetWorkitem(id)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, wi)
+	}
+
+	return orphans, nil
+}
+
+// GetEpicTree returns the workitems under the epic and the parent-child links between them
+func (r *AzureDevopsWit) GetEpicTree(parentEpic int) (map[int]WorkItem, []WorkItemRelations, error) {
+	links, err := r.loadWorkitemLinks(parentEpic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items := make(map[int]WorkItem)
+	for _, l := range links {
+		if _, ok := items[l.Target.Id]; ok {
+			continue
+		}
+
+		wi, err := r.GetWorkitem(l.Target.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		items[wi.Id] = wi
+	}
+
+	return items, links, nil
+}
+
+func (r *AzureDevopsWit) runWiql(query string) (WitQueryResult, error) {
+	URL := "_apis/wit/wiql?api-version=4.1"
+
+	var wiqlQuery WiqlQuery
+	wiqlQuery.Query = query
+	request, err := r.client.NewRequest("POST", URL, wiqlQuery)
+	if err != nil {
+		return WitQueryResult{}, err
+	}
+
+	var response WitQueryResult
+	_, err = r.client.Execute(request, &response)
+	return response, err
+}
+
+// auditTree checks each parent-child link of an epic tree and adds the problems to the report
+func auditTree(report *AuditReport, items map[int]WorkItem, links []WorkItemRelations) {
+	for _, l := range links {
+		if l.Source == nil {
+			continue
+		}
+
+		parent, ok := items[l.Source.Id]
+		if !ok {
+			continue
+		}
+		child := items[l.Target.Id]
+
+		parentLevel, pok := backlogLevels[parent.Type]
+		childLevel, cok := backlogLevels[child.Type]
+		if pok && cok && childLevel != parentLevel+1 {
+			report.Misparented = append(report.Misparented, AuditIssue{child, parent,
+				fmt.Sprintf("%v under %v", child.Type, parent.Type)})
+		}
+
+		parentBucket := stateBucket(parent.State)
+		childBucket := stateBucket(child.State)
+		switch {
+		case parentBucket == StateDone && childBucket != StateDone:
+			report.Inconsistent = append(report.Inconsistent, AuditIssue{child, parent,
+				fmt.Sprintf("%v under %v parent", child.State, parent.State)})
+		case parentBucket == StateNotDone && (childBucket == StateInProgress || childBucket == StateDone):
+			report.Inconsistent = append(report.Inconsistent, AuditIssue{child, parent,
+				fmt.Sprintf("%v under parent not started", child.State)})
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // RS384 and RS512
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Caller is who sent a request, along with the roles that say what they can see
+type Caller struct {
+	Name  string
+	Roles []string
+
+	unrestricted bool // auth is not configured
+}
+
+// Authenticator finds out who sent a request. It returns a nil caller without an error when the
+// request has no credentials it knows about, so that the next one can try.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Caller, error)
+
+	// Challenge is the WWW-Authenticate header telling the client how to authenticate
+	Challenge() string
+}
+
+// The authenticators are tried in order, the endpoints are open to anyone when there is none
+var authenticators []Authenticator
+var roles map[string]RoleConfig
+
+var anonymous = &Caller{Name: "anonymous", unrestricted: true}
+
+// Can tells whether the caller can see the endpoint of the profile. The endpoint is the path under
+// the root of the profile, e.g. /wit/burn, / for the dashboard and /images for the charts.
+func (c *Caller) Can(p *Profile, endpoint string) bool {
+	if c == nil {
+		return false
+	}
+	if c.unrestricted {
+		return true
+	}
+
+	for _, name := range c.Roles {
+		if role, ok := roles[name]; ok && role.allows(p, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+func (role RoleConfig) allows(p *Profile, endpoint string) bool {
+	name := p.Name
+	if len(name) == 0 {
+		name = defaultProfileName
+	}
+
+	return matchesAny(role.Profiles, name) && matchesAny(role.Endpoints, endpoint)
+}
+
+// matchesAny matches the value against patterns like /wit/* where * is anything but a /, or a
+// single * that matches everything
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok || pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+type callerKey struct{}
+
+// requestCaller returns who sent the request, nil if it did not go through authorize
+func requestCaller(r *http.Request) *Caller {
+	caller, _ := r.Context().Value(callerKey{}).(*Caller)
+	return caller
+}
+
+// authenticate returns who sent the request, nil if nobody could tell
+func authenticate(r *http.Request) (*Caller, error) {
+	if len(authenticators) == 0 {
+		return anonymous, nil
+	}
+
+	for _, a := range authenticators {
+		caller, err := a.Authenticate(r)
+		if err != nil || caller != nil {
+			return caller, err
+		}
+	}
+	return nil, nil
+}
+
+// authorize serves the request only if the caller can see the endpoint of the requested profile
+func authorize(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := authenticate(r)
+		if err != nil || caller == nil {
+			if err == nil {
+				err = errors.New("no credentials")
+			}
+			Warning.Printf("Unauthorized request for %v from %v: %v\n", r.URL.Path, r.RemoteAddr, err)
+			for _, a := range authenticators {
+				if !contains(w.Header()["Www-Authenticate"], a.Challenge()) {
+					w.Header().Add("WWW-Authenticate", a.Challenge())
+				}
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !caller.Can(requestProfile(r), endpoint) {
+			Warning.Printf("%v is not allowed to see %v\n", caller.Name, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		Info.Printf("Request for %v by %v\n", r.URL.Path, caller.Name)
+		h(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+	}
+}
+
+// cacheScope keeps shared caches from storing the responses when they need auth
+func cacheScope() string {
+	if len(authenticators) > 0 {
+		return "private"
+	}
+	return "public"
+}
+
+// secretMatches compares the secret of the config, in plain text or as sha256:<hex digest>, to the
+// one given in the request
+func secretMatches(secret, given string) bool {
+	if strings.HasPrefix(secret, sha256Prefix) {
+		sum := sha256.Sum256([]byte(given))
+		digest := strings.ToLower(strings.TrimPrefix(secret, sha256Prefix))
+		return subtle.ConstantTimeCompare([]byte(digest), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(given)) == 1
+}
+
+const sha256Prefix = "sha256:"
+
+// bearerToken returns the token of the Authorization header, empty if there is none
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// ================================================================================================
+// Static tokens
+// tokenAuth accepts the API keys of the config in the X-Api-Key header or as bearer tokens
+type tokenAuth struct {
+	tokens []TokenConfig
+}
+
+func (a *tokenAuth) Authenticate(r *http.Request) (*Caller, error) {
+	key := r.Header.Get("X-Api-Key")
+	fromHeader := len(key) != 0
+	if !fromHeader {
+		key = bearerToken(r)
+	}
+	if len(key) == 0 {
+		return nil, nil
+	}
+
+	for _, t := range a.tokens {
+		if secretMatches(t.Token, key) {
+			return &Caller{Name: t.Name, Roles: t.Roles}, nil
+		}
+	}
+
+	// A bearer token that is not one of ours may still be a JWT
+	if fromHeader {
+		return nil, errors.New("unknown API key")
+	}
+	return nil, nil
+}
+
+func (a *tokenAuth) Challenge() string {
+	return `Bearer realm="devops"`
+}
+
+// ================================================================================================
+// Basic auth
+type basicAuth struct {
+	users []UserConfig
+}
+
+func (a *basicAuth) Authenticate(r *http.Request) (*Caller, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	for _, u := range a.users {
+		if u.Name == name && secretMatches(u.Password, password) {
+			return &Caller{Name: u.Name, Roles: u.Roles}, nil
+		}
+	}
+	return nil, fmt.Errorf("wrong password for user %q", name)
+}
+
+func (a *basicAuth) Challenge() string {
+	return `Basic realm="devops", charset="UTF-8"`
+}
+
+// ================================================================================================
+// OIDC
+const (
+	jwtLeeway       = time.Minute // clock skew allowed for exp and nbf
+	jwksMaxAge      = time.Hour   // how long the keys of the issuer are used before they are fetched again
+	jwksMinInterval = time.Minute // how often an unknown key id can trigger fetching the keys
+	oidcTimeout     = 10 * time.Second
+)
+
+// The RSA signatures a JWT can have
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// oidcAuth accepts bearer JWTs signed by the issuer for the audience. The roles are taken from a
+// claim of the token.
+type oidcAuth struct {
+	config OIDCConfig
+	keys   *keySet
+}
+
+func newOIDCAuth(config OIDCConfig) *oidcAuth {
+	return &oidcAuth{
+		config: config,
+		keys: &keySet{
+			issuer: config.Issuer,
+			url:    config.JWKSURL,
+			file:   config.JWKSFile,
+			client: &http.Client{Timeout: oidcTimeout},
+		},
+	}
+}
+
+func (a *oidcAuth) Authenticate(r *http.Request) (*Caller, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+
+	caller, err := a.verify(token, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT: %v", err)
+	}
+	return caller, nil
+}
+
+func (a *oidcAuth) Challenge() string {
+	return `Bearer realm="devops"`
+}
+
+// audience is the aud claim, which is either a string or a list of them
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*aud = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expires   *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// verify checks the signature and the claims of the token and returns the caller it is for
+func (a *oidcAuth) verify(token string, now time.Time) (*Caller, error) {
+	parts := strings.Split(token, ".")
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := a.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature); err != nil {
+		return nil, errors.New("wrong signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+
+	switch {
+	case claims.Issuer != a.config.Issuer:
+		return nil, fmt.Errorf("issued by %q", claims.Issuer)
+	case !contains(claims.Audience, a.config.Audience):
+		return nil, fmt.Errorf("not for audience %q", a.config.Audience)
+	case claims.Expires == nil:
+		return nil, errors.New("no expiry")
+	case now.Add(-jwtLeeway).After(time.Unix(int64(*claims.Expires), 0)):
+		return nil, errors.New("expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)):
+		return nil, errors.New("not valid yet")
+	}
+
+	// The other claims can be of any type
+	var all map[string]interface{}
+	if err := decodeSegment(parts[1], &all); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+
+	caller := &Caller{Name: claims.Subject}
+	for _, claim := range []string{"preferred_username", "email"} {
+		if name, ok := all[claim].(string); ok && len(name) != 0 {
+			caller.Name = name
+			break
+		}
+	}
+
+	switch v := all[a.config.RolesClaim].(type) {
+	case string:
+		caller.Roles = append(caller.Roles, v)
+	case []interface{}:
+		for _, role := range v {
+			if role, ok := role.(string); ok {
+				caller.Roles = append(caller.Roles, role)
+			}
+		}
+	}
+	caller.Roles = append(caller.Roles, a.config.DefaultRoles...)
+
+	return caller, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// keySet is the public keys of the issuer, fetched from its JWKS when they are first needed, once
+// they are old, or when a token is signed with a key that is not in there yet
+type keySet struct {
+	issuer string
+	url    string // found with the discovery document of the issuer when empty
+	file   string // a local JWKS instead of the url
+
+	client *http.Client
+
+	m         sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time     // when the keys were last fetched
+	attempted time.Time     // when fetching them was last tried, even if it failed
+	fetching  chan struct{} // closed when the fetch in flight is done, nil when there is none
+}
+
+func (s *keySet) key(kid string) (*rsa.PublicKey, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for {
+		key, ok := s.lookup(kid)
+		switch {
+		case ok && time.Since(s.fetched) < jwksMaxAge:
+			return key, nil
+		case s.fetching != nil:
+			// Wait for the fetch in flight rather than starting another one
+			done := s.fetching
+			s.m.Unlock()
+			<-done
+			s.m.Lock()
+		case time.Since(s.attempted) < jwksMinInterval:
+			// The keys were just fetched or the issuer just failed, either way make do with what we have
+			if ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("unknown key %q", kid)
+		default:
+			s.refresh()
+		}
+	}
+}
+
+// refresh fetches the keys, which can take up to oidcTimeout, without holding the lock it is
+// called with
+func (s *keySet) refresh() {
+	done := make(chan struct{})
+	s.fetching = done
+	s.attempted = time.Now()
+	s.m.Unlock()
+
+	keys, err := s.fetch()
+
+	s.m.Lock()
+	s.fetching = nil
+	close(done)
+	if err != nil {
+		// Rather than locking everybody out, keep using the keys we have
+		Error.Println("Error fetching the keys of", s.issuer, err)
+		return
+	}
+	s.keys = keys
+	s.fetched = time.Now()
+}
+
+// lookup finds the key by id, tokens without an id can only be signed by the only key
+func (s *keySet) lookup(kid string) (*rsa.PublicKey, bool) {
+	if len(kid) == 0 && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (s *keySet) fetch() (map[string]*rsa.PublicKey, error) {
+	var data []byte
+	var err error
+	if len(s.file) != 0 {
+		data, err = ioutil.ReadFile(s.file)
+	} else {
+		data, err = s.fetchKeys()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (len(k.Use) != 0 && k.Use != "sig") {
+			continue
+		}
+
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			Warning.Println("Skipping invalid key", k.Kid, "of", s.issuer)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	Info.Printf("Fetched %v keys of %v\n", len(keys), s.issuer)
+
+	return keys, nil
+}
+
+// fetchKeys gets the JWKS, finding its url in the discovery document of the issuer if need be
+func (s *keySet) fetchKeys() ([]byte, error) {
+	if len(s.url) == 0 {
+		data, err := s.get(strings.TrimSuffix(s.issuer, "/") + "/.well-known/openid-configuration")
+		if err != nil {
+			return nil, err
+		}
+
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := json.Unmarshal(data, &discovery); err != nil {
+			return nil, fmt.Errorf("invalid discovery document: %v", err)
+		}
+		switch {
+		case discovery.Issuer != s.issuer:
+			return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+		case len(discovery.JWKSURI) == 0:
+			return nil, errors.New("discovery document has no jwks_uri")
+		}
+		s.url = discovery.JWKSURI
+	}
+
+	return s.get(s.url)
+}
+
+func (s *keySet) get(url string) ([]byte, error) {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v returned %v", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
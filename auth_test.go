@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	Info = log.New(ioutil.Discard, "", 0)
+	Warning = log.New(ioutil.Discard, "", 0)
+	Error = log.New(ioutil.Discard, "", 0)
+}
+
+const (
+	testIssuer   = "https://login.example.com/tenant/"
+	testAudience = "api://devops"
+)
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeJWKS writes the public keys, by key id, as a JWKS file
+func writeJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) string {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		jwks.Keys = append(jwks.Keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	data, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// signJWT signs the claims with the key, the signature is garbage for algorithms we do not support
+func signJWT(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := segment(header) + "." + segment(claims)
+	hash, ok := jwtHashes[header["alg"].(string)]
+	if !ok {
+		return signed + "." + base64.RawURLEncoding.EncodeToString([]byte("signature"))
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	key, other := newTestKey(t), newTestKey(t)
+	a := newOIDCAuth(OIDCConfig{
+		Issuer:       testIssuer,
+		Audience:     testAudience,
+		JWKSFile:     writeJWKS(t, map[string]*rsa.PrivateKey{"k1": key}),
+		RolesClaim:   "roles",
+		DefaultRoles: []string{"reader"},
+	})
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                testIssuer,
+			"aud":                testAudience,
+			"sub":                "b5d1f0",
+			"preferred_username": "trillian@example.com",
+			"roles":              []string{"admin"},
+			"exp":                now.Add(time.Hour).Unix(),
+			"nbf":                now.Add(-time.Minute).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "k1", "typ": "JWT"}
+
+	tests := []struct {
+		name   string
+		token  string
+		err    string // part of the error, empty if the token is valid
+		caller Caller
+	}{
+		{
+			name:   "valid",
+			token:  signJWT(t, key, rs256, claims(nil)),
+			caller: Caller{Name: "trillian@example.com", Roles: []string{"admin", "reader"}},
+		},
+		{
+			name:   "RS384",
+			token:  signJWT(t, key, map[string]interface{}{"alg": "RS384", "kid": "k1"}, claims(nil)),
+			caller: Caller{Name: "trillian@example.com", Roles: []string{"admin", "reader"}},
+		},
+		{
+			name:   "no key id with a single key",
+			token:  signJWT(t, key, map[string]interface{}{"alg": "RS256"}, claims(nil)),
+			caller: Caller{Name: "trillian@example.com", Roles: []string{"admin", "reader"}},
+		},
+		{
+			name:   "audience list",
+			token:  signJWT(t, key, rs256, claims(map[string]interface{}{"aud": []string{"other", testAudience}})),
+			caller: Caller{Name: "trillian@example.com", Roles: []string{"admin", "reader"}},
+		},
+		{
+			name:   "email and a single role",
+			token:  signJWT(t, key, rs256, claims(map[string]interface{}{"preferred_username": nil, "email": "ford@example.com", "roles": "admin"})),
+			caller: Caller{Name: "ford@example.com", Roles: []string{"admin", "reader"}},
+		},
+		{
+			name:   "subject and no roles",
+			token:  signJWT(t, key, rs256, claims(map[string]interface{}{"preferred_username": nil, "roles": nil})),
+			caller: Caller{Name: "b5d1f0", Roles: []string{"reader"}},
+		},
+		{
+			name:   "expired within the leeway",
+			token:  signJWT(t, key, rs256, claims(map[string]interface{}{"exp": now.Add(-jwtLeeway / 2).Unix()})),
+			caller: Caller{Name: "trillian@example.com", Roles: []string{"admin", "reader"}},
+		},
+		{
+			name:  "HS256",
+			token: signJWT(t, key, map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims(nil)),
+			err:   "unsupported algorithm",
+		},
+		{
+			name:  "none",
+			token: signJWT(t, key, map[string]interface{}{"alg": "none", "kid": "k1"}, claims(nil)),
+			err:   "unsupported algorithm",
+		},
+		{
+			name:  "unknown key id",
+			token: signJWT(t, other, map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims(nil)),
+			err:   "unknown key",
+		},
+		{
+			name:  "signed with another key",
+			token: signJWT(t, other, rs256, claims(nil)),
+			err:   "wrong signature",
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				parts := strings.Split(signJWT(t, key, rs256, claims(nil)), ".")
+				forged := strings.Split(signJWT(t, key, rs256, claims(map[string]interface{}{"roles": []string{"root"}})), ".")
+				return parts[0] + "." + forged[1] + "." + parts[2]
+			}(),
+			err: "wrong signature",
+		},
+		{
+			name:  "expired",
+			token: signJWT(t, key, rs256, claims(map[string]interface{}{"exp": now.Add(-2 * jwtLeeway).Unix()})),
+			err:   "expired",
+		},
+		{
+			name:  "no expiry",
+			token: signJWT(t, key, rs256, claims(map[string]interface{}{"exp": nil})),
+			err:   "no expiry",
+		},
+		{
+			name:  "not valid yet",
+			token: signJWT(t, key, rs256, claims(map[string]interface{}{"nbf": now.Add(2 * jwtLeeway).Unix()})),
+			err:   "not valid yet",
+		},
+		{
+			name:  "wrong audience",
+			token: signJWT(t, key, rs256, claims(map[string]interface{}{"aud": "api://other"})),
+			err:   "not for audience",
+		},
+		{
+			name:  "wrong issuer",
+			token: signJWT(t, key, rs256, claims(map[string]interface{}{"iss": "https://login.example.com/other/"})),
+			err:   "issued by",
+		},
+	}
+
+	for _, test := range tests {
+		caller, err := a.verify(test.token, now)
+		switch {
+		case len(test.err) != 0 && err == nil:
+			t.Errorf("%v: got %+v, want an error with %q", test.name, caller, test.err)
+		case len(test.err) != 0 && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%v: got error %q, want one with %q", test.name, err, test.err)
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%v: got error %q", test.name, err)
+		case len(test.err) == 0 && !reflect.DeepEqual(*caller, test.caller):
+			t.Errorf("%v: got %+v, want %+v", test.name, *caller, test.caller)
+		}
+	}
+}
+
+// The issuer being down must neither hold up the other requests nor be asked more than once
+// per jwksMinInterval
+func TestKeySetFetchesOnce(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s := &keySet{issuer: testIssuer, url: srv.URL, client: srv.Client()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.key("k1"); err == nil {
+				t.Error("got a key from a failing issuer")
+			}
+		}()
+	}
+
+	// The lock is not held while fetching
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		s.m.Lock()
+		s.m.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the lock is held while fetching the keys")
+	}
+
+	close(release)
+	wg.Wait()
+
+	if _, err := s.key("k1"); err == nil {
+		t.Error("got a key from a failing issuer")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("fetched the keys %v times, want once", n)
+	}
+}
+
+func TestCallerCan(t *testing.T) {
+	saved := roles
+	defer func() { roles = saved }()
+	roles = map[string]RoleConfig{
+		"admin":  {Profiles: []string{"*"}, Endpoints: []string{"*"}},
+		"reader": {Profiles: []string{"default", "team-*"}, Endpoints: []string{"/", "/images", "/wit/*", "/sprint"}},
+		"pr":     {Profiles: []string{"teamb"}, Endpoints: []string{"/pr", "/pr.png"}},
+	}
+
+	def, teamb, teamc := &Profile{}, &Profile{Name: "teamb"}, &Profile{Name: "team-c"}
+	tests := []struct {
+		caller   *Caller
+		profile  *Profile
+		endpoint string
+		want     bool
+	}{
+		{anonymous, teamb, "/pr", true},
+		{nil, def, "/", false},
+		{&Caller{Roles: []string{"admin"}}, teamb, "/wit/burn", true},
+		{&Caller{Roles: []string{"reader"}}, def, "/", true},
+		{&Caller{Roles: []string{"reader"}}, def, "/wit/burn", true},
+		{&Caller{Roles: []string{"reader"}}, def, "/wit", false},
+		{&Caller{Roles: []string{"reader"}}, def, "/pr", false},
+		{&Caller{Roles: []string{"reader"}}, teamc, "/sprint", true},
+		{&Caller{Roles: []string{"reader"}}, teamc, "/sprint/velocity", false},
+		{&Caller{Roles: []string{"reader"}}, teamb, "/", false},
+		{&Caller{Roles: []string{"pr"}}, teamb, "/pr.png", true},
+		{&Caller{Roles: []string{"pr"}}, def, "/pr", false},
+		{&Caller{Roles: []string{"pr", "reader"}}, def, "/wit/cfd", true},
+		{&Caller{Roles: []string{"unknown"}}, def, "/", false},
+		{&Caller{}, def, "/", false},
+	}
+
+	for _, test := range tests {
+		if got := test.caller.Can(test.profile, test.endpoint); got != test.want {
+			t.Errorf("%+v.Can(%q, %q) = %v, want %v", test.caller, test.profile.Name, test.endpoint, got, test.want)
+		}
+	}
+}
+
+func TestSecretMatches(t *testing.T) {
+	sum := sha256.Sum256([]byte("change-me"))
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		secret, given string
+		want          bool
+	}{
+		{"change-me", "change-me", true},
+		{"change-me", "change-me ", false},
+		{"change-me", "", false},
+		{"sha256:" + digest, "change-me", true},
+		{"sha256:" + strings.ToUpper(digest), "change-me", true},
+		{"sha256:" + digest, "change-you", false},
+		{"sha256:" + digest, "sha256:" + digest, false},
+		{"sha256:", "", false},
+	}
+
+	for _, test := range tests {
+		if got := secretMatches(test.secret, test.given); got != test.want {
+			t.Errorf("secretMatches(%q, %q) = %v, want %v", test.secret, test.given, got, test.want)
+		}
+	}
+}
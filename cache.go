@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a successful response of a report handler
+type CachedResponse struct {
+	Header  http.Header
+	Body    []byte
+	ETag    string
+	Created time.Time
+	Expires time.Time // served as fresh till then
+}
+
+// flight is a handler run that concurrent identical requests wait on
+type flight struct {
+	wg       sync.WaitGroup
+	rec      *responseRecorder // nil if the handler panicked
+	response *CachedResponse   // nil if the response was not cached
+}
+
+type cacheEntry struct {
+	response   *CachedResponse
+	refreshing bool // a background refresh is running
+}
+
+// ResultCache keeps the responses of the report handlers in memory keyed by the endpoint and the
+// params. A response is fresh for ttl (or till the next run of a scheduled report), after which it
+// is still served for stale while it is refreshed in the background. Identical requests that come
+// in while the handler is running wait for it and share its response, even when caching is
+// disabled.
+type ResultCache struct {
+	ttl   time.Duration
+	stale time.Duration
+
+	m       sync.Mutex
+	entries map[string]*cacheEntry
+	flights map[string]*flight
+}
+
+func NewResultCache(ttl, stale time.Duration) *ResultCache {
+	return &ResultCache{
+		ttl:     ttl,
+		stale:   stale,
+		entries: make(map[string]*cacheEntry),
+		flights: make(map[string]*flight),
+	}
+}
+
+// cacheKey is the path and the sorted params along with the format, which is the same whether it
+// is asked for with the format param or the Accept header. A scheduled /pr then serves the
+// dashboard's /pr?format=text too.
+func cacheKey(r *http.Request) string {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = acceptedFormat(r)
+	}
+	query.Del("format")
+
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, name+"="+v)
+		}
+	}
+
+	return r.URL.Path + "?" + strings.Join(params, "&") + "|" + format
+}
+
+// responseRecorder captures what a handler writes so that it can be cached
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+// Handler serves GET requests from the cache, running h on a miss or to refresh a stale response
+func (c *ResultCache) Handler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The format of the report can come from the Accept header, so shared caches must tell
+		// the responses apart by it
+		w.Header().Set("Vary", "Accept")
+
+		if r.Method != http.MethodGet {
+			h(w, r)
+			return
+		}
+
+		key := cacheKey(r)
+		now := time.Now()
+
+		c.m.Lock()
+		entry, ok := c.entries[key]
+		if ok {
+			switch {
+			case now.Before(entry.response.Expires):
+				c.m.Unlock()
+				Info.Println("Serving from cache", key)
+				c.write(w, r, entry.response)
+				return
+			case now.Before(entry.response.Expires.Add(c.stale)):
+				if !entry.refreshing {
+					entry.refreshing = true
+					// The request is done by the time the refresh runs
+					go c.refresh(key, h, r.WithContext(context.Background()))
+				}
+				c.m.Unlock()
+				Info.Println("Serving stale from cache", key)
+				c.write(w, r, entry.response)
+				return
+			}
+		}
+		c.m.Unlock()
+
+		f, shared := c.run(key, h, r, c.expiry())
+		if shared {
+			Info.Println("Shared the response of a running request", key)
+		}
+
+		switch {
+		case f.rec == nil:
+			w.WriteHeader(http.StatusInternalServerError)
+		case f.response != nil:
+			c.write(w, r, f.response)
+		default:
+			copyHeader(w.Header(), f.rec.header)
+			w.WriteHeader(f.rec.status)
+			w.Write(f.rec.body.Bytes())
+		}
+	}
+}
+
+// expiry is when a response cached now expires, zero when caching is disabled
+func (c *ResultCache) expiry() time.Time {
+	if c.ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.ttl)
+}
+
+// run runs h unless an identical request is already running it, in which case it waits for that
+// one to finish. The response is cached till expires unless that is zero. The second return value
+// is true when the response is shared.
+func (c *ResultCache) run(key string, h http.HandlerFunc, r *http.Request, expires time.Time) (*flight, bool) {
+	c.m.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.m.Unlock()
+		f.wg.Wait()
+		return f, true
+	}
+
+	f := &flight{}
+	f.wg.Add(1)
+	c.flights[key] = f
+	c.m.Unlock()
+
+	defer func() {
+		c.m.Lock()
+		delete(c.flights, key)
+		c.m.Unlock()
+		f.wg.Done()
+	}()
+
+	rec := newResponseRecorder()
+	h(rec, r)
+	if !expires.IsZero() && rec.status == http.StatusOK {
+		f.response = c.store(key, rec, expires)
+	}
+	f.rec = rec
+
+	return f, false
+}
+
+func (c *ResultCache) refresh(key string, h http.HandlerFunc, r *http.Request) {
+	Info.Println("Refreshing cache", key)
+
+	// Keep serving the stale response until it expires, and let the next request retry
+	failed := func() {
+		c.m.Lock()
+		if entry, ok := c.entries[key]; ok {
+			entry.refreshing = false
+		}
+		c.m.Unlock()
+	}
+
+	// Unlike the http server this goroutine has nobody to recover a panic of the handler
+	defer func() {
+		if p := recover(); p != nil {
+			Error.Println("Refreshing panicked", key, p)
+			failed()
+		}
+	}()
+
+	if f, _ := c.run(key, h, r, c.expiry()); f.response == nil {
+		Warning.Println("Refreshing failed", key)
+		failed()
+	}
+}
+
+// store caches the recorded response, dropping the ones that are too old to be served
+func (c *ResultCache) store(key string, rec *responseRecorder, expires time.Time) *CachedResponse {
+	response := &CachedResponse{
+		Header:  rec.header,
+		Body:    rec.body.Bytes(),
+		ETag:    fmt.Sprintf("\"%x\"", sha1.Sum(rec.body.Bytes())),
+		Created: time.Now(),
+		Expires: expires,
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	for k, e := range c.entries {
+		if !response.Created.Before(e.response.Expires.Add(c.stale)) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &cacheEntry{response: response}
+
+	return response
+}
+
+// write sends the response with its ETag, or just 304 when the client already has it
+func (c *ResultCache) write(w http.ResponseWriter, r *http.Request, response *CachedResponse) {
+	copyHeader(w.Header(), response.Header)
+
+	age := time.Since(response.Created)
+	w.Header().Set("ETag", response.ETag)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	if len(w.Header().Get("Cache-Control")) == 0 {
+		maxAge := response.Expires.Sub(time.Now())
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("%v, max-age=%v, stale-while-revalidate=%v",
+			cacheScope(), int(maxAge.Seconds()), int(c.stale.Seconds())))
+	}
+
+	if match := r.Header.Get("If-None-Match"); len(match) != 0 {
+		for _, etag := range strings.Split(match, ",") {
+			if etag = strings.TrimSpace(etag); etag == response.ETag || etag == "*" {
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(response.Body)
+}
+
+// Warm runs h for the request, even if its response is cached, and caches the new response till
+// expires. It returns the status of the response.
+func (c *ResultCache) Warm(h http.HandlerFunc, r *http.Request, expires time.Time) (status int) {
+	// Unlike the http server the caller has nobody to recover a panic of the handler
+	defer func() {
+		if p := recover(); p != nil {
+			Error.Println("Handler panicked", r.URL, p)
+			status = http.StatusInternalServerError
+		}
+	}()
+
+	f, _ := c.run(cacheKey(r), h, r, expires)
+	if f.rec == nil {
+		return http.StatusInternalServerError
+	}
+	return f.rec.status
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FieldChange is a change to one of the fields we track in a revision of a workitem
+type FieldChange struct {
+	Date  time.Time
+	Field string
+	Old   string
+	New   string
+}
+
+type WorkItemChange struct {
+	WorkItem WorkItem
+	Changes  []FieldChange
+}
+
+type EpicChanges struct {
+	Epic  WorkItem
+	Items []WorkItemChange
+}
+
+// GetEpicChanges returns the workitems under the epic that changed state, assignee or title after
+// since, along with the ones that were moved into or out of the epic. The removed ones are kept.
+func (r *AzureDevopsWit) GetEpicChanges(epic WorkItem, since time.Time) (EpicChanges, error) {
+	changes := EpicChanges{Epic: epic}
+
+	current, err := r.loadTreeIds(epic.Id, time.Time{})
+	if err != nil {
+		return changes, err
+	}
+
+	before, err := r.loadTreeIds(epic.Id, since)
+	if err != nil {
+		return changes, err
+	}
+
+	var ids []int
+	for id := range current {
+		ids = append(ids, id)
+	}
+	for id := range before {
+		if !current[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		wi, err := r.GetWorkitem(id)
+		if err != nil {
+			return changes, err
+		}
+
+		// Only the ones changed since need their history fetched. Moving a workitem changes it too.
+		if wi.Type == "Epic" || !wi.ChangedDate.After(since) {
+			continue
+		}
+
+		h, err := r.GetWorkitemHistory(wi.Id)
+		if err != nil {
+			return changes, err
+		}
+
+		// The revisions do not have the parent, so the move is dated by the latest change
+		c := getFieldChanges(h, since)
+		_, existed := h.At(since)
+		switch {
+		case before[id] && !current[id]:
+			c = append(c, FieldChange{wi.ChangedDate, "Epic", strconv.Itoa(epic.Id), "moved out"})
+		case current[id] && !before[id] && existed:
+			c = append(c, FieldChange{wi.ChangedDate, "Epic", "moved in", strconv.Itoa(epic.Id)})
+		}
+
+		if len(c) > 0 {
+			changes.Items = append(changes.Items, WorkItemChange{wi, c})
+		}
+	}
+
+	return changes, nil
+}
+
+// loadTreeIds returns the ids of the workitems under the epic, including the removed ones, as they
+// were at asOf or now if that is zero
+func (r *AzureDevopsWit) loadTreeIds(parentEpic int, asOf time.Time) (map[int]bool, error) {
+	query := fmt.Sprintf(`
+	SELECT [System.Id]
+	FROM workitemLinks
+	WHERE
+		(
+			[Source].[System.TeamProject] = @project
+			AND [Source].[System.Id] = %v
+		)
+		AND (
+			[System.Links.LinkType] = 'System.LinkTypes.Hierarchy-Forward'
+		)
+	%s
+	MODE (Recursive)
+	`, parentEpic, asOfClause(asOf))
+
+	res, err := r.runWiql(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int]bool)
+	for _, id := range res.Ids() {
+		if id != parentEpic {
+			ids[id] = true
+		}
+	}
+
+	return ids, nil
+}
+
+func asOfClause(asOf time.Time) string {
+	if asOf.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("ASOF '%v'", asOf.UTC().Format(time.RFC3339))
+}
+
+// getFieldChanges diffs the revisions made after since
+func getFieldChanges(h WorkItemHistory, since time.Time) []FieldChange {
+	var changes []FieldChange
+
+	prev, existed := h.At(since)
+	for _, rev := range h.Revisions {
+		if !rev.ChangedDate.After(since) {
+			continue
+		}
+
+		if !existed {
+			changes = append(changes, FieldChange{rev.ChangedDate, "Created", "", rev.State})
+			prev, existed = rev, true
+			continue
+		}
+
+		if rev.State != prev.State {
+			changes = append(changes, FieldChange{rev.ChangedDate, "State", prev.State, rev.State})
+		}
+		if rev.AssignedTo != prev.AssignedTo {
+			changes = append(changes, FieldChange{rev.ChangedDate, "Assigned To", prev.AssignedTo, rev.AssignedTo})
+		}
+		if rev.Title != prev.Title {
+			changes = append(changes, FieldChange{rev.ChangedDate, "Title", prev.Title, rev.Title})
+		}
+		prev = rev
+	}
+
+	return changes
+}
+
+// ================================================================================================
+// Output
+func writeChangesText(buffer *bytes.Buffer, since time.Time, epics []EpicChanges) {
+	buffer.WriteString(fmt.Sprintf("Changes since %v\n\n", since.Format("2006-01-02 15:04")))
+	for _, e := range epics {
+		if len(e.Items) == 0 {
+			continue
+		}
+
+		buffer.WriteString(fmt.Sprintf("%v: %v (%v)\n", e.Epic.Id, e.Epic.Title, e.Epic.AssignedTo))
+		for _, item := range e.Items {
+			buffer.WriteString(fmt.Sprintf("  %v: %v (%v)\n", item.WorkItem.Id, item.WorkItem.Title, item.WorkItem.AssignedTo))
+			for _, c := range item.Changes {
+				buffer.WriteString(fmt.Sprintf("    %v %v: %v -> %v\n", c.Date.Local().Format("01-02 15:04"), c.Field, c.Old, c.New))
+			}
+		}
+		buffer.WriteString("\n")
+	}
+}
+
+var changesTemplate = template.Must(template.New("changes").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Changes since {{.Since.Format "2006-01-02 15:04"}}</title>
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 2px 8px; text-align: left; }
+.old { color: #a00; }
+.new { color: #0a0; }
+</style>
+</head>
+<body>
+<h1>Changes since {{.Since.Format "2006-01-02 15:04"}}</h1>
+{{range .Epics}}{{if .Items}}
+<h2>{{.Epic.Id}}: {{.Epic.Title}} ({{.Epic.AssignedTo}})</h2>
+<table>
+<tr><th>Workitem</th><th>When</th><th>Field</th><th>From</th><th>To</th></tr>
+{{range .Items}}{{$wi := .WorkItem}}{{range .Changes}}
+<tr><td>{{$wi.Id}}: {{$wi.Title}}</td><td>{{.Date.Local.Format "01-02 15:04"}}</td><td>{{.Field}}</td><td class="old">{{.Old}}</td><td class="new">{{.New}}</td></tr>
+{{end}}{{end}}
+</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
+
+func writeChangesHTML(buffer *bytes.Buffer, since time.Time, epics []EpicChanges) error {
+	return changesTemplate.Execute(buffer, struct {
+		Since time.Time
+		Epics []EpicChanges
+	}{since, epics})
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config is the settings of the server. It is read from the -config file, after which the
+// environment variables and then the flags given on the command line override it.
+type Config struct {
+	Port      int               `json:"port"`
+	DevOps    DevOpsConfig      `json:"devops"`
+	Queries   QueryConfig       `json:"queries"`
+	Exclude   ExcludeConfig     `json:"exclude"`
+	States    map[string]string `json:"states"` // workitem state to todo, inprogress or done
+	Periods   PeriodConfig      `json:"periods"`
+	Storage   StorageConfig     `json:"storage"`
+	Cache     CacheConfig       `json:"cache"`
+	Schedules []string          `json:"schedules"` // e.g. "0 7 * * 1-5 /pr?count=400"
+
+	// Other projects, possibly in other accounts, served at /{name}/. What they leave out is
+	// taken from devops and queries above.
+	Profiles map[string]ProfileConfig `json:"profiles"`
+
+	Auth AuthConfig `json:"auth"`
+}
+
+type ProfileConfig struct {
+	DevOps  DevOpsConfig `json:"devops"`
+	Queries QueryConfig  `json:"queries"`
+}
+
+type DevOpsConfig struct {
+	Account string `json:"account"`
+	Project string `json:"project"`
+	Token   string `json:"token"`
+	Repo    string `json:"repo"`
+	Team    string `json:"team"` // defaults to "<project> Team"
+}
+
+type QueryConfig struct {
+	Epics string `json:"epics"` // saved query returning the epics
+}
+
+type ExcludeConfig struct {
+	Reviewers []string `json:"reviewers"` // e.g. groups that are added as reviewers to every pull request
+	Epics     []int    `json:"epics"`
+}
+
+type PeriodConfig struct {
+	Semester    bool `json:"semester"` // skip workitems finished before this semester
+	PrCount     int  `json:"prCount"`
+	BurnDays    int  `json:"burnDays"`
+	SprintCount int  `json:"sprintCount"`
+	StaleDays   int  `json:"staleDays"`
+	WipLimit    int  `json:"wipLimit"`
+}
+
+type StorageConfig struct {
+	Type    string `json:"type"` // azure, or none to only keep the images in the working directory
+	Account string `json:"account"`
+	Key     string `json:"key"`
+}
+
+type CacheConfig struct {
+	TTL   string `json:"ttl"` // durations like "5m"
+	Stale string `json:"stale"`
+}
+
+// AuthConfig is who can call the endpoints. The endpoints are open to anyone when it has neither
+// tokens, users nor oidc.
+type AuthConfig struct {
+	Tokens []TokenConfig         `json:"tokens"`
+	Users  []UserConfig          `json:"users"`
+	OIDC   *OIDCConfig           `json:"oidc"`
+	Roles  map[string]RoleConfig `json:"roles"`
+}
+
+// TokenConfig is an API key, sent as a bearer token or in the X-Api-Key header
+type TokenConfig struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token"` // plain text or sha256:<hex digest>
+	Roles []string `json:"roles"`
+}
+
+// UserConfig is a user of HTTP basic auth
+type UserConfig struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"` // plain text or sha256:<hex digest>
+	Roles    []string `json:"roles"`
+}
+
+// OIDCConfig is the issuer whose JWTs are accepted as bearer tokens
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	Audience     string   `json:"audience"`
+	JWKSURL      string   `json:"jwksUrl"`  // found with the discovery document of the issuer when empty
+	JWKSFile     string   `json:"jwksFile"` // a local JWKS instead
+	RolesClaim   string   `json:"rolesClaim"`
+	DefaultRoles []string `json:"defaultRoles"` // given to every valid token
+}
+
+// RoleConfig is the profiles and the endpoints under them that a role can see, as patterns like
+// /wit/* or *. The default profile is named default.
+type RoleConfig struct {
+	Profiles  []string `json:"profiles"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// ConfigError points at the key of the config that is wrong
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid config %v: %v", e.Key, e.Message)
+}
+
+// currentConfig returns the settings the globals have, which are the defaults or the flags
+func currentConfig() Config {
+	return Config{
+		Port: port,
+		DevOps: DevOpsConfig{
+			Account: devOpsAccount,
+			Project: devOpsProject,
+			Token:   devOpsToken,
+			Repo:    devOpsRepo,
+			Team:    devOpsTeam,
+		},
+		Queries: QueryConfig{Epics: defaultEpicWitQuery},
+		Exclude: ExcludeConfig{Reviewers: excludedReviewers, Epics: excludedEpics},
+		Periods: PeriodConfig{
+			Semester:    semesterFilter,
+			PrCount:     defaultPrCount,
+			BurnDays:    defaultBurnDays,
+			SprintCount: defaultSprintCount,
+			StaleDays:   staleDays,
+			WipLimit:    wipLimit,
+		},
+		Storage: StorageConfig{Type: "azure", Account: azStorageAcc, Key: azStorageKey},
+		Cache:   CacheConfig{TTL: cacheTTL.String(), Stale: cacheStale.String()},
+	}
+}
+
+// loadConfig reads the json config file over cfg, so that what the file leaves out keeps its value
+func loadConfig(fileName string, cfg *Config) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &syntaxErr):
+		line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+		return fmt.Errorf("Invalid config %v line %v: %v", fileName, line, err)
+	case errors.As(err, &typeErr):
+		return &ConfigError{typeErr.Field, fmt.Sprintf("%v expected", typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// The decoder only names the key, find where it is
+		name := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), "\"")
+		var raw interface{}
+		if json.Unmarshal(data, &raw) == nil {
+			for _, key := range unknownKeys(raw, reflect.TypeOf(*cfg), "") {
+				if key == name || strings.HasSuffix(key, "."+name) {
+					return &ConfigError{key, "unknown key"}
+				}
+			}
+		}
+		return &ConfigError{name, "unknown key"}
+	default:
+		return fmt.Errorf("Invalid config %v: %v", fileName, err)
+	}
+}
+
+// unknownKeys returns the full paths, like devops.acount or auth.tokens[0].nme, of the keys in the
+// decoded json that t has no field for
+func unknownKeys(v interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var keys []string
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct && t.Kind() != reflect.Map {
+			return nil
+		}
+
+		var names []string
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			elem := t
+			if t.Kind() == reflect.Map {
+				elem = t.Elem()
+			} else if field, ok := jsonField(t, name); ok {
+				elem = field.Type
+			} else {
+				keys = append(keys, prefix+name)
+				continue
+			}
+			keys = append(keys, unknownKeys(value[name], elem, prefix+name+".")...)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, item := range value {
+			keys = append(keys, unknownKeys(item, t.Elem(), fmt.Sprintf("%v[%v].", strings.TrimSuffix(prefix, "."), i))...)
+		}
+	}
+
+	return keys
+}
+
+// jsonField returns the field of the struct that the json key is decoded into, ignoring case
+// like encoding/json
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if len(field.PkgPath) != 0 || name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// applyEnv overrides the config with the environment variables that are set
+func applyEnv(cfg *Config) {
+	env := []struct {
+		name  string
+		value *string
+	}{
+		{"AZUREDEVOPS_ACCOUNT", &cfg.DevOps.Account},
+		{"AZUREDEVOPS_PROJECT", &cfg.DevOps.Project},
+		{"AZUREDEVOPS_TOKEN", &cfg.DevOps.Token},
+		{"AZUREDEVOPS_REPO", &cfg.DevOps.Repo},
+		{"AZUREDEVOPS_TEAM", &cfg.DevOps.Team},
+		{"AZURE_STORAGE_ACCOUNT", &cfg.Storage.Account},
+		{"AZURE_STORAGE_ACCESS_KEY", &cfg.Storage.Key},
+	}
+
+	for _, e := range env {
+		if v := os.Getenv(e.name); len(v) != 0 {
+			*e.value = v
+		}
+	}
+}
+
+// applyFlags overrides the config with the flags given on the command line
+func applyFlags(cfg *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = port
+		case "sem":
+			cfg.Periods.Semester = semesterFilter
+		case "wip":
+			cfg.Periods.WipLimit = wipLimit
+		case "stale":
+			cfg.Periods.StaleDays = staleDays
+		case "cache":
+			cfg.Cache.TTL = cacheTTL.String()
+		case "cachestale":
+			cfg.Cache.Stale = cacheStale.String()
+		case "schedule":
+			cfg.Schedules = strings.Split(schedules, ";")
+		case "nu":
+			if noUpload {
+				cfg.Storage.Type = "none"
+			} else {
+				cfg.Storage.Type = "azure"
+			}
+		}
+	})
+}
+
+// validate checks the config, naming the key that is wrong
+func (cfg *Config) validate() error {
+	required := []struct {
+		key, env, value string
+	}{
+		{"devops.account", "AZUREDEVOPS_ACCOUNT", cfg.DevOps.Account},
+		{"devops.project", "AZUREDEVOPS_PROJECT", cfg.DevOps.Project},
+		{"devops.token", "AZUREDEVOPS_TOKEN", cfg.DevOps.Token},
+		{"devops.repo", "AZUREDEVOPS_REPO", cfg.DevOps.Repo},
+		{"queries.epics", "", cfg.Queries.Epics},
+	}
+
+	switch cfg.Storage.Type {
+	case "azure":
+		required = append(required, []struct{ key, env, value string }{
+			{"storage.account", "AZURE_STORAGE_ACCOUNT", cfg.Storage.Account},
+			{"storage.key", "AZURE_STORAGE_ACCESS_KEY", cfg.Storage.Key},
+		}...)
+	case "none":
+	default:
+		return &ConfigError{"storage.type", fmt.Sprintf("unknown type %q, use azure or none", cfg.Storage.Type)}
+	}
+
+	for _, r := range required {
+		if len(r.value) != 0 {
+			continue
+		}
+		if len(r.env) != 0 {
+			return &ConfigError{r.key, "missing, set it in the config file or " + r.env}
+		}
+		return &ConfigError{r.key, "missing"}
+	}
+
+	positive := []struct {
+		key   string
+		value int
+	}{
+		{"port", cfg.Port},
+		{"periods.prCount", cfg.Periods.PrCount},
+		{"periods.burnDays", cfg.Periods.BurnDays},
+		{"periods.sprintCount", cfg.Periods.SprintCount},
+		{"periods.staleDays", cfg.Periods.StaleDays},
+		{"periods.wipLimit", cfg.Periods.WipLimit},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return &ConfigError{p.key, fmt.Sprintf("%v is not positive", p.value)}
+		}
+	}
+
+	switch {
+	case cfg.Periods.PrCount > maxPrCount:
+		return &ConfigError{"periods.prCount", fmt.Sprintf("%v is more than %v", cfg.Periods.PrCount, maxPrCount)}
+	case cfg.Periods.BurnDays > maxBurnDays:
+		return &ConfigError{"periods.burnDays", fmt.Sprintf("%v is more than %v", cfg.Periods.BurnDays, maxBurnDays)}
+	case cfg.Periods.SprintCount > maxSprintCount:
+		return &ConfigError{"periods.sprintCount", fmt.Sprintf("%v is more than %v", cfg.Periods.SprintCount, maxSprintCount)}
+	}
+
+	durations := []struct {
+		key, value string
+	}{
+		{"cache.ttl", cfg.Cache.TTL},
+		{"cache.stale", cfg.Cache.Stale},
+	}
+	for _, d := range durations {
+		if v, err := time.ParseDuration(d.value); err != nil {
+			return &ConfigError{d.key, fmt.Sprintf("%q is not a duration like 5m or 1h", d.value)}
+		} else if v < 0 {
+			return &ConfigError{d.key, "negative duration"}
+		}
+	}
+
+	for name, pc := range cfg.Profiles {
+		key := "profiles." + name
+		if !profileName.MatchString(name) || reservedProfileNames[name] {
+			return &ConfigError{key, "name should be lowercase letters, digits and - and not default, wit, pr, sprint or images"}
+		}
+
+		devops := cfg.profileDevOps(pc)
+		required := []struct {
+			key, value string
+		}{
+			{key + ".devops.account", devops.Account},
+			{key + ".devops.project", devops.Project},
+			{key + ".devops.token", devops.Token},
+			{key + ".devops.repo", devops.Repo},
+		}
+		for _, r := range required {
+			if len(r.value) == 0 {
+				return &ConfigError{r.key, "missing"}
+			}
+		}
+	}
+
+	// An empty name is part of every reviewer name
+	for i, name := range cfg.Exclude.Reviewers {
+		if len(strings.TrimSpace(name)) == 0 {
+			return &ConfigError{fmt.Sprintf("exclude.reviewers[%v]", i), "empty name"}
+		}
+	}
+
+	for state, bucket := range cfg.States {
+		if _, ok := bucketNames[bucket]; !ok {
+			return &ConfigError{"states." + state, fmt.Sprintf("unknown bucket %q, use todo, inprogress or done", bucket)}
+		}
+	}
+
+	return cfg.validateAuth()
+}
+
+func (cfg *Config) validateAuth() error {
+	auth := cfg.Auth
+
+	checkRoles := func(key string, names []string) error {
+		for _, name := range names {
+			if _, ok := auth.Roles[name]; !ok {
+				return &ConfigError{key, fmt.Sprintf("unknown role %q", name)}
+			}
+		}
+		return nil
+	}
+
+	checkSecret := func(key, secret string) error {
+		if len(secret) == 0 {
+			return &ConfigError{key, "missing"}
+		}
+		if strings.HasPrefix(secret, sha256Prefix) {
+			if digest, err := hex.DecodeString(strings.TrimPrefix(secret, sha256Prefix)); err != nil || len(digest) != sha256.Size {
+				return &ConfigError{key, "sha256: should be followed by 64 hex digits"}
+			}
+		}
+		return nil
+	}
+
+	for i, t := range auth.Tokens {
+		key := fmt.Sprintf("auth.tokens[%v]", i)
+		switch {
+		case len(t.Name) == 0:
+			return &ConfigError{key + ".name", "missing"}
+		case len(t.Roles) == 0:
+			return &ConfigError{key + ".roles", "missing"}
+		}
+		if err := checkSecret(key+".token", t.Token); err != nil {
+			return err
+		}
+		if err := checkRoles(key+".roles", t.Roles); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, u := range auth.Users {
+		key := fmt.Sprintf("auth.users[%v]", i)
+		switch {
+		case len(u.Name) == 0 || strings.Contains(u.Name, ":"):
+			return &ConfigError{key + ".name", "missing or has a :"}
+		case names[u.Name]:
+			return &ConfigError{key + ".name", fmt.Sprintf("%q is there twice", u.Name)}
+		case len(u.Roles) == 0:
+			return &ConfigError{key + ".roles", "missing"}
+		}
+		names[u.Name] = true
+		if err := checkSecret(key+".password", u.Password); err != nil {
+			return err
+		}
+		if err := checkRoles(key+".roles", u.Roles); err != nil {
+			return err
+		}
+	}
+
+	if oidc := auth.OIDC; oidc != nil {
+		if u, err := url.Parse(oidc.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return &ConfigError{"auth.oidc.issuer", fmt.Sprintf("%q is not a url", oidc.Issuer)}
+		}
+		if len(oidc.Audience) == 0 {
+			return &ConfigError{"auth.oidc.audience", "missing"}
+		}
+		if len(oidc.JWKSURL) != 0 && len(oidc.JWKSFile) != 0 {
+			return &ConfigError{"auth.oidc.jwksFile", "use either jwksUrl or jwksFile"}
+		}
+		if err := checkRoles("auth.oidc.defaultRoles", oidc.DefaultRoles); err != nil {
+			return err
+		}
+	}
+
+	for name, role := range auth.Roles {
+		key := "auth.roles." + name
+		for _, p := range role.Profiles {
+			if _, ok := cfg.Profiles[p]; !ok && p != defaultProfileName && p != "*" {
+				return &ConfigError{key + ".profiles", fmt.Sprintf("unknown profile %q", p)}
+			}
+		}
+		for _, e := range role.Endpoints {
+			if _, err := path.Match(e, ""); err != nil || (e != "*" && !strings.HasPrefix(e, "/")) {
+				return &ConfigError{key + ".endpoints", fmt.Sprintf("%q is not a pattern like /wit/* or *", e)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// profileDevOps fills in what the profile leaves out from the top level devops settings. The team
+// defaults to the one named after the project when the profile has its own project.
+func (cfg *Config) profileDevOps(pc ProfileConfig) DevOpsConfig {
+	devops := pc.DevOps
+	if len(devops.Team) == 0 && len(devops.Project) == 0 {
+		devops.Team = cfg.DevOps.Team
+	}
+	if len(devops.Account) == 0 {
+		devops.Account = cfg.DevOps.Account
+	}
+	if len(devops.Project) == 0 {
+		devops.Project = cfg.DevOps.Project
+	}
+	if len(devops.Token) == 0 {
+		devops.Token = cfg.DevOps.Token
+	}
+	if len(devops.Repo) == 0 {
+		devops.Repo = cfg.DevOps.Repo
+	}
+	if len(devops.Team) == 0 {
+		devops.Team = devops.Project + " Team"
+	}
+	return devops
+}
+
+// bucketNames are the state buckets the states can be mapped to in the config
+var bucketNames = map[string]int{
+	"todo":       StateNotDone,
+	"inprogress": StateInProgress,
+	"done":       StateDone,
+}
+
+// apply sets the globals from the validated config
+func (cfg *Config) apply() {
+	port = cfg.Port
+	devOpsAccount = cfg.DevOps.Account
+	devOpsProject = cfg.DevOps.Project
+	devOpsToken = cfg.DevOps.Token
+	devOpsRepo = cfg.DevOps.Repo
+	devOpsTeam = cfg.DevOps.Team
+
+	// Azure DevOps creates a default team named after the project
+	if len(devOpsTeam) == 0 {
+		devOpsTeam = devOpsProject + " Team"
+	}
+
+	defaultEpicWitQuery = cfg.Queries.Epics
+	excludedReviewers = cfg.Exclude.Reviewers
+	excludedEpics = cfg.Exclude.Epics
+	for state, bucket := range cfg.States {
+		stateBuckets[state] = bucketNames[bucket]
+	}
+
+	semesterFilter = cfg.Periods.Semester
+	defaultPrCount = cfg.Periods.PrCount
+	defaultBurnDays = cfg.Periods.BurnDays
+	defaultSprintCount = cfg.Periods.SprintCount
+	staleDays = cfg.Periods.StaleDays
+	wipLimit = cfg.Periods.WipLimit
+
+	noUpload = cfg.Storage.Type == "none"
+	azStorageAcc = cfg.Storage.Account
+	azStorageKey = cfg.Storage.Key
+
+	cacheTTL, _ = time.ParseDuration(cfg.Cache.TTL)
+	cacheStale, _ = time.ParseDuration(cfg.Cache.Stale)
+
+	defaultProfile = NewProfile("", DevOpsConfig{devOpsAccount, devOpsProject, devOpsToken, devOpsRepo, devOpsTeam}, defaultEpicWitQuery)
+
+	var names []string
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	profiles = nil
+	for _, name := range names {
+		pc := cfg.Profiles[name]
+		epicQuery := pc.Queries.Epics
+		if len(epicQuery) == 0 {
+			epicQuery = defaultEpicWitQuery
+		}
+		profiles = append(profiles, NewProfile(name, cfg.profileDevOps(pc), epicQuery))
+	}
+
+	roles = cfg.Auth.Roles
+	authenticators = nil
+	if len(cfg.Auth.Tokens) > 0 {
+		authenticators = append(authenticators, &tokenAuth{cfg.Auth.Tokens})
+	}
+	if len(cfg.Auth.Users) > 0 {
+		authenticators = append(authenticators, &basicAuth{cfg.Auth.Users})
+	}
+	if oidc := cfg.Auth.OIDC; oidc != nil {
+		config := *oidc
+		if len(config.RolesClaim) == 0 {
+			config.RolesClaim = "roles"
+		}
+		authenticators = append(authenticators, newOIDCAuth(config))
+	}
+}
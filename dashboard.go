@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Generated images are saved in the working directory as <prefix>_<date>.png
+// or the directory of their profile
+var imageName = regexp.MustCompile(`^([a-z0-9-]+/)?[a-z]+(_[A-Za-z0-9-]+)*\.png$`)
+
+// latestImage returns the most recently generated image with the prefix, empty if there is none.
+// The date in the name sorts the images by when they were generated.
+func latestImage(images *ImageStore, prefix string) string {
+	files, err := filepath.Glob(images.Path(prefix + "_*.png"))
+	if err != nil || len(files) == 0 {
+		return ""
+	}
+
+	sort.Strings(files)
+	return filepath.ToSlash(files[len(files)-1])
+}
+
+type dashboard struct {
+	Base         string // root of the profile the links are under
+	Profiles     []*Profile
+	Project      string
+	Team         string
+	PrImage      string
+	EpicImage    string
+	PrCount      int
+	MaxPrCount   int
+	QueryId      string
+	BurnDays     int
+	MaxBurnDays  int
+	From         string
+	To           string
+	SprintCount  int
+	WipLimit     int
+	ChangesSince string
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>DevOps {{.Project}}</title>
+<style>
+body { font-family: sans-serif; margin: 0 24px; }
+section { border-top: 1px solid #ccc; padding: 8px 0 16px; }
+img { max-width: 100%; border: 1px solid #eee; }
+form { margin: 8px 0; }
+label { margin-right: 12px; }
+.missing { color: #888; }
+</style>
+</head>
+<body>
+<h1>DevOps {{.Project}}</h1>
+{{if .Profiles}}<p>{{range .Profiles}}<a href="{{.Root}}/">{{if .Name}}{{.Name}}{{else}}default{{end}}</a> {{end}}</p>{{end}}
+
+<section>
+<h2>Pull requests</h2>
+{{if .PrImage}}<img src="/images/{{.PrImage}}" alt="Reviewer stats">
+{{else}}<p class="missing">No reviewer chart yet, run the report to generate it.</p>
+{{end}}
+<form action="{{.Base}}/pr">
+<label>Pull requests <input type="number" name="count" min="1" max="{{.MaxPrCount}}" value="{{.PrCount}}"></label>
+<label>Format <select name="format"><option>text</option><option>json</option><option>csv</option><option>tsv</option></select></label>
+<button>Reviewer stats</button>
+<button formaction="{{.Base}}/pr.png">Chart</button>
+</form>
+</section>
+
+<section>
+<h2>Epics</h2>
+{{if .EpicImage}}<img src="/images/{{.EpicImage}}" alt="Epic stats">
+{{else}}<p class="missing">No epic chart yet, run the report to generate it.</p>
+{{end}}
+<form action="{{.Base}}/wit">
+<label>Query <input name="queryid" size="38" value="{{.QueryId}}"></label>
+<label>Weight <select name="weight"><option>count</option><option>points</option></select></label>
+<label>Group by <select name="groupby"><option>epic</option><option>tag</option><option>area</option></select></label>
+<label>Area <input name="area"></label>
+<label><input type="checkbox" name="forecast" value="true"> Forecast</label>
+<label>Format <select name="format"><option>text</option><option>json</option><option>csv</option><option>tsv</option></select></label>
+<button>Epic stats</button>
+<button formaction="{{.Base}}/wit.png">Chart</button>
+</form>
+<ul>
+<li><a href="{{.Base}}/wit/people?queryid={{.QueryId}}&amp;wip={{.WipLimit}}">Workload per person</a></li>
+<li><a href="{{.Base}}/wit/audit?queryid={{.QueryId}}">Orphaned and misparented workitems</a></li>
+<li><a href="{{.Base}}/wit/deps?queryid={{.QueryId}}">Dependencies</a> (<a href="{{.Base}}/wit/deps?queryid={{.QueryId}}&amp;format=dot">dot</a>, <a href="{{.Base}}/wit/deps?queryid={{.QueryId}}&amp;format=mermaid">mermaid</a>)</li>
+<li><a href="{{.Base}}/wit/changes?queryid={{.QueryId}}&amp;since={{.ChangesSince}}&amp;format=html">Changes in the last day</a></li>
+</ul>
+</section>
+
+<section>
+<h2>Flow</h2>
+<form action="{{.Base}}/wit/burn">
+<label>Epic <input type="number" name="epic" required></label>
+<label>Days <input type="number" name="days" min="1" max="{{.MaxBurnDays}}" value="{{.BurnDays}}"></label>
+<label>Format <select name="format"><option>text</option><option>csv</option><option>tsv</option></select></label>
+<button>Burn up/down</button>
+</form>
+<form action="{{.Base}}/wit/cfd">
+<label>Epic <input type="number" name="epic"></label>
+<label>or query <input name="queryid" size="38"></label>
+<label>From <input type="date" name="from" value="{{.From}}"></label>
+<label>To <input type="date" name="to" value="{{.To}}"></label>
+<label>Format <select name="format"><option>text</option><option>csv</option><option>tsv</option></select></label>
+<button>Cumulative flow</button>
+<button formaction="{{.Base}}/wit/flowtime">Lead and cycle time</button>
+</form>
+</section>
+
+<section>
+<h2>Sprints</h2>
+<form action="{{.Base}}/sprint">
+<label>Team <input name="team" value="{{.Team}}"></label>
+<label>Format <select name="format"><option>text</option><option>csv</option><option>tsv</option></select></label>
+<button>Current sprint</button>
+</form>
+<form action="{{.Base}}/sprint/velocity">
+<label>Team <input name="team" value="{{.Team}}"></label>
+<label>Sprints <input type="number" name="count" min="1" value="{{.SprintCount}}"></label>
+<label>Format <select name="format"><option>text</option><option>csv</option><option>tsv</option></select></label>
+<button>Velocity</button>
+</form>
+</section>
+
+<section>
+<h2>Query</h2>
+<form action="{{.Base}}/wit/query" method="post">
+<textarea name="wiql" rows="4" cols="100">SELECT [System.Id] FROM workitems WHERE [System.AssignedTo] = @Me</textarea><br>
+<button>Run</button>
+</form>
+</section>
+</body>
+</html>
+`))
+
+// rootHandler serves the dashboard with the latest charts and forms for each report
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	if r.URL.Path != p.Root()+"/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	d := dashboard{
+		Base:         p.Root(),
+		Project:      p.Project,
+		Team:         p.Team,
+		PrImage:      latestImage(p.Images, "revstat"),
+		EpicImage:    latestImage(p.Images, "epicstat"),
+		PrCount:      defaultPrCount,
+		MaxPrCount:   maxPrCount,
+		QueryId:      p.EpicQuery,
+		BurnDays:     defaultBurnDays,
+		MaxBurnDays:  maxBurnDays,
+		From:         now.AddDate(0, 0, -defaultBurnDays).Format("2006-01-02"),
+		To:           now.Format("2006-01-02"),
+		SprintCount:  defaultSprintCount,
+		WipLimit:     wipLimit,
+		ChangesSince: now.AddDate(0, 0, -1).Format("2006-01-02"),
+	}
+	if len(profiles) > 0 {
+		caller := requestCaller(r)
+		for _, p := range allProfiles() {
+			if caller.Can(p, "/") {
+				d.Profiles = append(d.Profiles, p)
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := dashboardTemplate.Execute(&buffer, d); err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+// imageHandler serves the images generated in the working directory so that the dashboard
+// does not need access to the Azure storage
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	name := strings.TrimPrefix(r.URL.Path, "/images/")
+	if !imageName.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Images are regenerated at most once a day under the same name
+	w.Header().Set("Cache-Control", cacheScope()+", max-age=300")
+	http.ServeFile(w, r, name)
+}
+
+// withImageProfile serves the image for the profile whose directory it is in
+func withImageProfile(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/images/")
+		dir := ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			dir = name[:i]
+		}
+
+		p := profileByName(dir)
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		withProfile(p, h)(w, r)
+	}
+}
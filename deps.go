@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	linkSuccessor   = "System.LinkTypes.Dependency-Forward"
+	linkPredecessor = "System.LinkTypes.Dependency-Reverse"
+	linkRelated     = "System.LinkTypes.Related"
+
+	maxIdsPerQuery = 200 // keep the IN clause well within the WIQL length limit
+)
+
+// DependencyNode is a workitem in the dependency graph along with the epic it is under,
+// 0 if it is not under any of the epics
+type DependencyNode struct {
+	WorkItem WorkItem
+	Epic     int
+}
+
+// DependencyEdge is either From being a predecessor of To, or From and To being related
+type DependencyEdge struct {
+	From    int
+	To      int
+	Related bool
+}
+
+type DependencyGraph struct {
+	Epics []WorkItem
+	Nodes map[int]*DependencyNode
+	Edges []DependencyEdge
+}
+
+// Blocking is true for a dependency whose predecessor is not done yet
+func (g *DependencyGraph) Blocking(e DependencyEdge) bool {
+	if e.Related {
+		return false
+	}
+	return stateBucket(g.Nodes[e.From].WorkItem.State) != StateDone
+}
+
+// GetDependencies returns the dependency and related links going out of the workitems, including
+// the predecessor links of workitems that depend on others
+func (r *AzureDevopsWit) GetDependencies(ids []int) ([]WorkItemRelations, error) {
+	body := `
+	SELECT [System.Id]
+	FROM workitemLinks
+	WHERE
+		(
+			[Source].[System.TeamProject] = @project
+			AND [Source].[System.Id] IN (%s)
+		)
+		AND (
+			[System.Links.LinkType] IN ('%s', '%s', '%s')
+		)
+	MODE (MustContain)
+	`
+
+	var links []WorkItemRelations
+	for start := 0; start < len(ids); start += maxIdsPerQuery {
+		end := start + maxIdsPerQuery
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var strs []string
+		for _, id := range ids[start:end] {
+			strs = append(strs, strconv.Itoa(id))
+		}
+
+		res, err := r.runWiql(fmt.Sprintf(body, strings.Join(strs, ","), linkSuccessor, linkPredecessor, linkRelated))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range res.WitRelations {
+			if l.Source != nil && len(l.Rel) != 0 {
+				links = append(links, l)
+			}
+		}
+	}
+
+	return links, nil
+}
+
+// GetDependencyGraph builds the graph of dependency and related links of the workitems under the epics
+func (r *AzureDevopsWit) GetDependencyGraph(epics []WorkItem) (*DependencyGraph, error) {
+	g := &DependencyGraph{Epics: epics, Nodes: make(map[int]*DependencyNode)}
+
+	var ids []int
+	for _, epic := range epics {
+		Info.Printf("Fetching workitems under epic %v: %v\n", epic.Id, epic.Title)
+		wits, err := r.loadWorkitems(epic.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, wi := range wits {
+			if _, ok := g.Nodes[wi.Id]; ok {
+				continue
+			}
+			g.Nodes[wi.Id] = &DependencyNode{wi, epic.Id}
+			ids = append(ids, wi.Id)
+		}
+	}
+
+	links, err := r.GetDependencies(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Related links show up from both ends, and a dependency between two of the workitems shows
+	// up both as successor and as predecessor
+	seen := make(map[DependencyEdge]bool)
+	for _, l := range links {
+		from, to := l.Source.Id, l.Target.Id
+		other := to
+		switch l.Rel {
+		case linkRelated:
+			if from > to {
+				from, to = to, from
+			}
+		case linkPredecessor:
+			from, to = to, from
+		}
+
+		e := DependencyEdge{from, to, l.Rel == linkRelated}
+		if seen[e] {
+			continue
+		}
+		seen[e] = true
+
+		// Workitems outside the epics are still shown
+		if _, ok := g.Nodes[other]; !ok {
+			wi, err := r.GetWorkitem(other)
+			if err != nil {
+				return nil, err
+			}
+			g.Nodes[other] = &DependencyNode{wi, 0}
+		}
+
+		g.Edges = append(g.Edges, e)
+	}
+
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+
+	return g, nil
+}
+
+// linkedNodes returns the ids of the nodes that have at least one edge, ordered by epic and id
+func (g *DependencyGraph) linkedNodes() []int {
+	linked := make(map[int]bool)
+	for _, e := range g.Edges {
+		linked[e.From] = true
+		linked[e.To] = true
+	}
+
+	var ids []int
+	for id := range linked {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := g.Nodes[ids[i]], g.Nodes[ids[j]]
+		if a.Epic != b.Epic {
+			return a.Epic < b.Epic
+		}
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+// ================================================================================================
+// Export
+func writeDependencyText(buffer *bytes.Buffer, g *DependencyGraph) {
+	for _, e := range g.Edges {
+		from, to := g.Nodes[e.From].WorkItem, g.Nodes[e.To].WorkItem
+		link := "blocks"
+		if e.Related {
+			link = "related to"
+		}
+
+		str := fmt.Sprintf("%v: %v [%v] %v %v: %v [%v]", from.Id, from.Title, from.State, link, to.Id, to.Title, to.State)
+		if g.Blocking(e) {
+			str += "  NOT DONE"
+		}
+		buffer.WriteString(str + "\n")
+	}
+}
+
+// writeDependencyDot writes the graph in Graphviz DOT with a cluster per epic
+func writeDependencyDot(buffer *bytes.Buffer, g *DependencyGraph) {
+	buffer.WriteString("digraph dependencies {\n")
+	buffer.WriteString("  rankdir=LR;\n  node [shape=box];\n")
+
+	byEpic := make(map[int][]int)
+	for _, id := range g.linkedNodes() {
+		byEpic[g.Nodes[id].Epic] = append(byEpic[g.Nodes[id].Epic], id)
+	}
+
+	writeNodes := func(indent string, ids []int) {
+		for _, id := range ids {
+			wi := g.Nodes[id].WorkItem
+			buffer.WriteString(fmt.Sprintf("%s%v [label=%q];\n", indent, id, fmt.Sprintf("%v: %v\n%v", id, wi.Title, wi.State)))
+		}
+	}
+
+	for _, epic := range g.Epics {
+		if len(byEpic[epic.Id]) == 0 {
+			continue
+		}
+		buffer.WriteString(fmt.Sprintf("  subgraph cluster_%v {\n    label=%q;\n", epic.Id, fmt.Sprintf("%v: %v", epic.Id, epic.Title)))
+		writeNodes("    ", byEpic[epic.Id])
+		buffer.WriteString("  }\n")
+	}
+	writeNodes("  ", byEpic[0])
+
+	for _, e := range g.Edges {
+		switch {
+		case e.Related:
+			buffer.WriteString(fmt.Sprintf("  %v -> %v [dir=none, style=dashed];\n", e.From, e.To))
+		case g.Blocking(e):
+			buffer.WriteString(fmt.Sprintf("  %v -> %v [color=red];\n", e.From, e.To))
+		default:
+			buffer.WriteString(fmt.Sprintf("  %v -> %v;\n", e.From, e.To))
+		}
+	}
+
+	buffer.WriteString("}\n")
+}
+
+// writeDependencyMermaid writes the graph as a Mermaid flowchart with a subgraph per epic
+func writeDependencyMermaid(buffer *bytes.Buffer, g *DependencyGraph) {
+	buffer.WriteString("graph LR\n")
+
+	byEpic := make(map[int][]int)
+	for _, id := range g.linkedNodes() {
+		byEpic[g.Nodes[id].Epic] = append(byEpic[g.Nodes[id].Epic], id)
+	}
+
+	// Mermaid labels can not contain quotes
+	label := func(s string) string {
+		return strings.Replace(s, "\"", "'", -1)
+	}
+
+	writeNodes := func(indent string, ids []int) {
+		for _, id := range ids {
+			wi := g.Nodes[id].WorkItem
+			buffer.WriteString(fmt.Sprintf("%sw%v[\"%v: %v<br/>%v\"]\n", indent, id, id, label(wi.Title), wi.State))
+		}
+	}
+
+	for _, epic := range g.Epics {
+		if len(byEpic[epic.Id]) == 0 {
+			continue
+		}
+		buffer.WriteString(fmt.Sprintf("  subgraph e%v[\"%v: %v\"]\n", epic.Id, epic.Id, label(epic.Title)))
+		writeNodes("    ", byEpic[epic.Id])
+		buffer.WriteString("  end\n")
+	}
+	writeNodes("  ", byEpic[0])
+
+	var blocking []int
+	for i, e := range g.Edges {
+		if e.Related {
+			buffer.WriteString(fmt.Sprintf("  w%v -.- w%v\n", e.From, e.To))
+		} else {
+			buffer.WriteString(fmt.Sprintf("  w%v --> w%v\n", e.From, e.To))
+		}
+
+		if g.Blocking(e) {
+			blocking = append(blocking, i)
+		}
+	}
+
+	for _, i := range blocking {
+		buffer.WriteString(fmt.Sprintf("  linkStyle %v stroke:red\n", i))
+	}
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,18 +20,37 @@ import (
 var verbose, noUpload bool
 var semesterFilter bool
 var port int
+var wipLimit int
+var staleDays int
+var cacheTTL, cacheStale time.Duration
+var schedules string
+var configFile string
 
 // Devops details
 var devOpsAccount, devOpsProject, devOpsToken, devOpsRepo string
+var devOpsTeam string
 
 // Azure Storage
 var azStorageAcc, azStorageKey string
 
+// Defaults of the params, which can be changed in the config file
+var (
+	defaultPrCount      = 200
+	defaultEpicWitQuery = "0325c50f-3511-4266-a9fe-80b989492c76"
+	defaultBurnDays     = 90
+	defaultSprintCount  = 6
+
+	excludedReviewers = []string{"AzLinux SAP HANA RP Devs"}
+	excludedEpics     []int
+)
+
 const (
-	defaultPrCount = 200
 	maxPrCount     = 1000
+	maxBurnDays    = 730
+	maxSprintCount = 26
+	velocityWindow = 3 // sprints in the rolling average
 
-	defaultEpicWitQuery = "0325c50f-3511-4266-a9fe-80b989492c76"
+	imageMaxAge = 15 * time.Minute // how long clients can cache the images served by /pr.png and /wit.png
 )
 
 // Log provides global logging
@@ -43,6 +66,12 @@ func main() {
 	flag.BoolVar(&noUpload, "nu", false, "Do not upload generated data into Azure")
 	flag.BoolVar(&semesterFilter, "sem", true, "Filter workitems not finished in this semester")
 	flag.IntVar(&port, "port", 80, "Port where the http server will listen")
+	flag.IntVar(&wipLimit, "wip", 3, "Max workitems a person should have in progress")
+	flag.IntVar(&staleDays, "stale", 14, "Days without change after which an in progress workitem is stale")
+	flag.DurationVar(&cacheTTL, "cache", 5*time.Minute, "How long reports are served from the cache, 0 to disable")
+	flag.DurationVar(&cacheStale, "cachestale", time.Hour, "How long expired reports are still served while they are refreshed")
+	flag.StringVar(&schedules, "schedule", "", "Reports to run on a cron schedule, separated by ; e.g. \"0 7 * * 1-5 /pr;@daily /wit\"")
+	flag.StringVar(&configFile, "config", "", "Json config file, overridden by the environment and the flags")
 	flag.Parse()
 
 	logFlags := log.Ldate | log.Ltime
@@ -55,39 +84,150 @@ func main() {
 	Warning = log.New(os.Stdout, "WRN: ", logFlags)
 	Error = log.New(os.Stderr, "ERR: ", logFlags)
 
+	cfg := currentConfig()
+	if len(configFile) != 0 {
+		if err := loadConfig(configFile, &cfg); err != nil {
+			Error.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	// Fetch the access stuff from environment
-	devOpsAccount = os.Getenv("AZUREDEVOPS_ACCOUNT")
-	devOpsProject = os.Getenv("AZUREDEVOPS_PROJECT")
-	devOpsToken = os.Getenv("AZUREDEVOPS_TOKEN")
-	devOpsRepo = os.Getenv("AZUREDEVOPS_REPO")
-	azStorageAcc = os.Getenv("AZURE_STORAGE_ACCOUNT")
-	azStorageKey = os.Getenv("AZURE_STORAGE_ACCESS_KEY")
-
-	if len(devOpsAccount) == 0 || len(devOpsProject) == 0 || len(devOpsToken) == 0 || len(devOpsRepo) == 0 ||
-		len(azStorageAcc) == 0 || len(azStorageKey) == 0 {
-		Error.Println("Environment not setup")
+	applyEnv(&cfg)
+	applyFlags(&cfg)
+	if err := cfg.validate(); err != nil {
+		Error.Println(err)
 		os.Exit(1)
 	}
+	cfg.apply()
 
 	addr := fmt.Sprintf(":%v", port)
 	Info.Printf("Starting to listen on %v", port)
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/wit", witHandler)
-	http.HandleFunc("/pr", prHandler)
+	reports := map[string]http.HandlerFunc{
+		"/wit":             witHandler,
+		"/wit/burn":        burnHandler,
+		"/wit/cfd":         cfdHandler,
+		"/wit/flowtime":    flowTimeHandler,
+		"/wit/people":      peopleHandler,
+		"/wit/query":       queryHandler,
+		"/wit/audit":       auditHandler,
+		"/wit/deps":        depsHandler,
+		"/wit/changes":     changesHandler,
+		"/pr":              prHandler,
+		"/pr.png":          prImageHandler,
+		"/wit.png":         witImageHandler,
+		"/sprint":          sprintHandler,
+		"/sprint/velocity": velocityHandler,
+	}
+
+	if err := createImageDirs(); err != nil {
+		Error.Println("Error creating image directories", err)
+		os.Exit(1)
+	}
+
+	// Each profile has the reports under its root
+	routes := make(map[string]http.HandlerFunc)
+	for _, p := range allProfiles() {
+		for path, h := range reports {
+			routes[p.Root()+path] = withProfile(p, h)
+		}
+	}
+
+	var jobs []ScheduledReport
+	for i, spec := range cfg.Schedules {
+		if len(strings.TrimSpace(spec)) == 0 {
+			continue
+		}
+
+		job, err := parseScheduledReport(spec, routes)
+		if err != nil {
+			Error.Println(&ConfigError{fmt.Sprintf("schedules[%v]", i), err.Error()})
+			os.Exit(1)
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(authenticators) == 0 {
+		Warning.Println("No auth in the config, the endpoints are open to anyone")
+	}
+
+	// The scheduled reports run the routes directly, the requests go through auth first
+	cache := NewResultCache(cacheTTL, cacheStale)
+	http.HandleFunc("/images/", withImageProfile(authorize("/images", imageHandler)))
+	for _, p := range allProfiles() {
+		http.HandleFunc(p.Root()+"/", withProfile(p, authorize("/", rootHandler)))
+		for path := range reports {
+			http.HandleFunc(p.Root()+path, withProfile(p, authorize(path, cache.Handler(routes[p.Root()+path]))))
+		}
+	}
+
+	for _, job := range jobs {
+		go runScheduledReport(job, routes, cache)
+	}
+
 	log.Fatal(http.ListenAndServe(addr, nil))
 
 }
 
 // ================================================================================================
 // Workitem
-func showWorkStats(acc, proj, token string, azStorageAcc, azStorageKey string, epicWitQuery string) (bytes.Buffer, error) {
-	var buffer bytes.Buffer
+// WorkStatOptions control what showWorkStats reports
+type WorkStatOptions struct {
+	Weighted bool   // story points instead of workitem counts
+	Forecast bool   // when each epic is likely to be done
+	GroupBy  string // epic, tag or area
+	Area     string // only count the workitems under this area path
+	Stale    int    // days without change after which an in progress workitem needs attention
+}
+
+// WitReport is the progress of each epic returned by the /wit API
+type WitReport struct {
+	GeneratedAt    time.Time   `json:"generatedAt"`
+	QueryId        string      `json:"queryId"`
+	Weighted       bool        `json:"weighted"`
+	Area           string      `json:"area,omitempty"`
+	GroupBy        string      `json:"groupBy"`
+	SemesterFilter bool        `json:"semesterFilter"`
+	SemesterStart  time.Time   `json:"semesterStart"` // done workitems changed before this are not counted
+	Epics          []EpicStat  `json:"epics"`
+	Groups         []GroupStat `json:"groups,omitempty"` // tags or area paths across the epics
+}
+
+func getWitReport(epicStats []EpicStat, queryId string, opts WorkStatOptions) WitReport {
+	now := time.Now()
+	report := WitReport{
+		GeneratedAt:    now,
+		QueryId:        queryId,
+		Weighted:       opts.Weighted,
+		Area:           opts.Area,
+		GroupBy:        opts.GroupBy,
+		SemesterFilter: semesterFilter,
+		SemesterStart:  semesterStart(now),
+		Epics:          epicStats,
+	}
+
+	switch opts.GroupBy {
+	case "tag":
+		report.Groups = mergeGroupStats(epicStats, func(e EpicStat) []GroupStat { return e.Tags })
+	case "area":
+		report.Groups = mergeGroupStats(epicStats, func(e EpicStat) []GroupStat { return e.Areas })
+	}
+
+	if report.Epics == nil {
+		report.Epics = []EpicStat{}
+	}
+
+	return report
+}
+
+// getEpicStats fetches the stats of each epic returned by the epic query
+func getEpicStats(acc, proj, token string, epicWitQuery string, opts WorkStatOptions) ([]EpicStat, error) {
 	// Get the list of epics from a epic's only query
 	Info.Printf("Fetching epics using query %v\n", epicWitQuery)
 
 	parentEpics, err := getEpics(acc, proj, token, epicWitQuery)
 	if err != nil {
-		return buffer, err
+		return nil, err
 	}
 
 	var epicStats []EpicStat
@@ -101,7 +241,7 @@ func showWorkStats(acc, proj, token string, azStorageAcc, azStorageKey string, e
 		wg.Add(1)
 		go func(epic int, m *sync.Mutex) {
 			defer wg.Done()
-			epicStat, err := getEpicStat(acc, proj, token, epic)
+			epicStat, err := getEpicStat(acc, proj, token, epic, opts)
 			m.Lock()
 			defer m.Unlock()
 			if err != nil {
@@ -118,10 +258,31 @@ func showWorkStats(acc, proj, token string, azStorageAcc, azStorageKey string, e
 	Info.Println("Starting wait for epic fetch to finish")
 	wg.Wait()
 
+	return epicStats, nil
+}
+
+// showWorkStats shows the progress of each epic, or of each tag or area path across the epics
+func showWorkStats(epicStats []EpicStat, opts WorkStatOptions, images *ImageStore) (bytes.Buffer, error) {
+	weighted := opts.Weighted
+	var buffer bytes.Buffer
+	var err error
+
+	switch opts.GroupBy {
+	case "tag":
+		tagStats := mergeGroupStats(epicStats, func(e EpicStat) []GroupStat { return e.Tags })
+		err = showGroupStats(&buffer, "Tag Status", "tagstat_", tagStats, images)
+		return buffer, err
+	case "area":
+		areaStats := mergeGroupStats(epicStats, func(e EpicStat) []GroupStat { return e.Areas })
+		err = showGroupStats(&buffer, "Area Status", "areastat_", areaStats, images)
+		return buffer, err
+	}
+
 	var maxBars float32 = 120.0
 	var maxCount float32
 	for _, e := range epicStats {
-		count := float32(e.Done + e.InProgress + e.NotDone + e.Unknown)
+		done, inProgress, notDone, unknown := e.Buckets(weighted)
+		count := float32(done + inProgress + notDone + unknown)
 		if count > maxCount {
 			maxCount = count
 		}
@@ -131,37 +292,84 @@ func showWorkStats(acc, proj, token string, azStorageAcc, azStorageKey string, e
 		str := fmt.Sprintf("%v: %v (%v)\n", e.Epic.Id, e.Epic.Title, e.Epic.AssignedTo)
 		buffer.WriteString(str)
 
-		str = fmt.Sprintf("Done:%v InProgress:%v ToDo:%v Unknown:%v\n", e.Done, e.InProgress, e.NotDone, e.Unknown)
+		done, inProgress, notDone, unknown := e.Buckets(weighted)
+		if weighted {
+			str = fmt.Sprintf("Points Done:%v InProgress:%v ToDo:%v Unknown:%v RemainingWork:%v\n",
+				done, inProgress, notDone, unknown, e.RemainingWork)
+		} else {
+			str = fmt.Sprintf("Done:%v InProgress:%v ToDo:%v Unknown:%v\n", done, inProgress, notDone, unknown)
+		}
 		buffer.WriteString(str)
 
+		if f := e.Forecast; f != nil {
+			if f.Valid() {
+				str = fmt.Sprintf("Forecast 50%%:%v 85%%:%v 95%%:%v (%v remaining, throughput %v)\n",
+					f.P50.Format("2006-01-02"), f.P85.Format("2006-01-02"), f.P95.Format("2006-01-02"), f.Remaining, f.Throughput)
+			} else {
+				str = fmt.Sprintf("Forecast not possible, nothing done in the last %v weeks\n", throughputWeeks)
+			}
+			buffer.WriteString(str)
+		}
+
+		if len(e.Attention) > 0 {
+			buffer.WriteString("Needs attention\n")
+			for _, a := range e.Attention {
+				buffer.WriteString(fmt.Sprintf("  %v: %v [%v] (%v) %v\n", a.WorkItem.Id, a.WorkItem.Title,
+					a.WorkItem.State, a.WorkItem.AssignedTo, strings.Join(a.Reasons, ", ")))
+			}
+		}
+
 		conv := maxBars / maxCount
-		drawBars(&buffer, '#', conv*float32(e.Done))
-		drawBars(&buffer, '=', conv*float32(e.InProgress))
-		drawBars(&buffer, '-', conv*float32(e.NotDone))
-		drawBars(&buffer, '.', conv*float32(e.Unknown))
+		drawBars(&buffer, '#', conv*float32(done))
+		drawBars(&buffer, '=', conv*float32(inProgress))
+		drawBars(&buffer, '-', conv*float32(notDone))
+		drawBars(&buffer, '.', conv*float32(unknown))
 		buffer.WriteString("\n\n")
 	}
 
 	// We support uploading 1 file per day
 	fileName := "epicstat_" + time.Now().Format("2006-01-02") + ".png"
-	err = saveWitStatImage(epicStats, fileName)
-	if err != nil {
+	if weighted {
+		fileName = "epicpoints_" + time.Now().Format("2006-01-02") + ".png"
+	}
+	if err := images.saveAndUpload(drawWitStatImage(epicStats, weighted), fileName); err != nil {
 		return buffer, err
 	}
 
-	if !noUpload {
-		url, err := uploadImageToAzure(azStorageAcc, azStorageKey, fileName)
-		if err != nil {
-			return buffer, err
+	return buffer, nil
+}
+
+func showGroupStats(buffer *bytes.Buffer, title, filePrefix string, groupStats []GroupStat, images *ImageStore) error {
+	var maxBars float32 = 120.0
+	var maxCount float32
+	for _, t := range groupStats {
+		count := float32(t.Done + t.InProgress + t.NotDone + t.Unknown)
+		if count > maxCount {
+			maxCount = count
 		}
+	}
+
+	for _, t := range groupStats {
+		buffer.WriteString(t.Name + "\n")
+		buffer.WriteString(fmt.Sprintf("Done:%v InProgress:%v ToDo:%v Unknown:%v\n", t.Done, t.InProgress, t.NotDone, t.Unknown))
 
-		Info.Println("Uploaded to", url)
+		conv := maxBars / maxCount
+		drawBars(buffer, '#', conv*float32(t.Done))
+		drawBars(buffer, '=', conv*float32(t.InProgress))
+		drawBars(buffer, '-', conv*float32(t.NotDone))
+		drawBars(buffer, '.', conv*float32(t.Unknown))
+		buffer.WriteString("\n\n")
+	}
 
+	fileName := filePrefix + time.Now().Format("2006-01-02") + ".png"
+	if err := images.saveAndUpload(drawGroupStatImage(title, groupStats), fileName); err != nil {
+		return err
 	}
 
-	return buffer, nil
+	return nil
 }
 
+// getEpics returns the epics of the query that are not excluded in the config
 func getEpics(acc, proj, token, queryID string) ([]WorkItem, error) {
 	q := NewWork(acc, proj, token)
 	epics, err := q.GetWorkitems(queryID)
@@ -169,160 +377,1396 @@ func getEpics(acc, proj, token, queryID string) ([]WorkItem, error) {
 		return nil, err
 	}
 
-	return epics, nil
+	var included []WorkItem
+	for _, epic := range epics {
+		if !containsInt(excludedEpics, epic.Id) {
+			included = append(included, epic)
+		}
+	}
+
+	return included, nil
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
 }
 
-func getEpicStat(acc, proj, token string, parentEpic int) (EpicStat, error) {
+func getEpicStat(acc, proj, token string, parentEpic int, opts WorkStatOptions) (EpicStat, error) {
 	q := NewWork(acc, proj, token)
 
-	stats, err := q.RefreshWit(parentEpic, semesterFilter)
+	stats, err := q.RefreshWit(parentEpic, semesterFilter, opts.Area, opts.Stale)
+	if err != nil || !opts.Forecast {
+		return stats, err
+	}
+
+	histories, err := q.GetEpicHistory(parentEpic)
+	if err != nil {
+		return stats, err
+	}
+
+	var inArea []WorkItemHistory
+	for _, h := range histories {
+		if inAreaPath(h.Latest().AreaPath, opts.Area) {
+			inArea = append(inArea, h)
+		}
+	}
 
-	return stats, err
+	now := time.Now()
+	throughput := getWeeklyThroughput(inArea, throughputWeeks, now)
+	f := forecastCompletion(stats.NotDone+stats.InProgress, throughput, now)
+	stats.Forecast = &f
+
+	return stats, nil
 }
 
-func drawBars(buffer *bytes.Buffer, ch rune, count float32) {
-	for i := 0; i < int(count); i++ {
-		buffer.WriteRune(ch)
+// getBurnStats returns the epic and the daily stats of the workitems under it for the last days
+func getBurnStats(acc, proj, token string, epicId, days int) (WorkItem, []DailyStat, error) {
+	q := NewWork(acc, proj, token)
+
+	epic, err := q.GetWorkitem(epicId)
+	if err != nil {
+		return epic, nil, err
+	}
+
+	Info.Printf("Fetching history of workitems under epic %v\n", epicId)
+	histories, err := q.GetEpicHistory(epicId)
+	if err != nil {
+		return epic, nil, err
 	}
+
+	now := time.Now()
+	return epic, getDailyStats(histories, now.AddDate(0, 0, -days), now), nil
 }
 
-// ================================================================================================
-// PR
-func showPrStats(acc, proj, token, repo string, count int, azStorageAcc, azStorageKey string) (bytes.Buffer, error) {
-	r := NewRepo(acc, proj, token, repo)
+func showBurnStats(epic WorkItem, stats []DailyStat, images *ImageStore) (bytes.Buffer, error) {
 	var buffer bytes.Buffer
-	if r.err != nil {
-		return buffer, r.err
+	buffer.WriteString(fmt.Sprintf("%v: %v (%v)\n", epic.Id, epic.Title, epic.AssignedTo))
+	buffer.WriteString(fmt.Sprintf("%-10s %6s %6s %9s\n", "Date", "Scope", "Done", "Remaining"))
+	for _, s := range stats {
+		buffer.WriteString(fmt.Sprintf("%-10s %6d %6d %9d\n", s.Date.Format("2006-01-02"), s.Total(), s.Done, s.Total()-s.Done))
 	}
 
-	// Fetch PRs
-	revStats, max := r.GetPullRequestReviewsByUser(count)
-	barmax := float32(80.0)
+	fileName := fmt.Sprintf("epicburn_%v_%v.png", epic.Id, time.Now().Format("2006-01-02"))
+	if err := images.saveAndUpload(drawBurnChartImage(epic, stats), fileName); err != nil {
+		return buffer, err
+	}
 
-	// Output!!
-	buffer.WriteString("\nReviewer Stats\n\n")
-	for _, revStat := range revStats {
-		bar := int((barmax / float32(max)) * float32(revStat.Count))
-		percentage := float32(revStat.Count) / float32(count) * 100.0
-		buffer.WriteString(fmt.Sprintf("%30s %4d (%4.1f%%) ", revStat.Name, revStat.Count, percentage))
-		buffer.WriteString("[")
-		i := 0
-		for ; i < bar; i++ {
-			buffer.WriteRune('#')
+	return buffer, nil
+}
+
+// getHistories fetches the history of the workitems under the epic, or returned by the query if
+// epicId is 0. It also returns a title for reports and a name to use in file names.
+func getHistories(q *AzureDevopsWit, epicId int, queryId string) (string, string, []WorkItemHistory, error) {
+	if epicId != 0 {
+		epic, err := q.GetWorkitem(epicId)
+		if err != nil {
+			return "", "", nil, err
 		}
 
-		for ; i < int(barmax); i++ {
-			buffer.WriteRune('-')
+		Info.Printf("Fetching history of workitems under epic %v\n", epicId)
+		histories, err := q.GetEpicHistory(epicId)
+		if err != nil {
+			return "", "", nil, err
 		}
-		buffer.WriteString("]\n")
+
+		title := fmt.Sprintf("%v : %s (%s)", epic.Id, epic.Title, epic.AssignedTo)
+		return title, strconv.Itoa(epicId), histories, nil
 	}
 
-	fileName := "revstat_" + time.Now().Format("2006-01-02") + ".png"
+	Info.Printf("Fetching history of workitems in query %v\n", queryId)
+	histories, err := q.GetQueryHistory(queryId)
+	if err != nil {
+		return "", "", nil, err
+	}
 
-	err := savePrStatImage(revStats, count, fileName)
+	return fmt.Sprintf("Query %v", queryId), queryId, histories, nil
+}
 
+// getCumulativeFlow returns the daily state bucket counts of the workitems under the epic, or
+// returned by the query if epicId is 0, along with the title and name from getHistories
+func getCumulativeFlow(acc, proj, token string, epicId int, queryId string, from, to time.Time) (string, string, []DailyStat, error) {
+	title, name, histories, err := getHistories(NewWork(acc, proj, token), epicId, queryId)
 	if err != nil {
-		return buffer, err
+		return title, name, nil, err
 	}
 
-	if !noUpload {
-		url, err := uploadImageToAzure(azStorageAcc, azStorageKey, fileName)
-		if err != nil {
-			return buffer, err
-		}
+	return title, name, getDailyStats(histories, from, to), nil
+}
+
+func showCumulativeFlow(title, name string, stats []DailyStat, images *ImageStore) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(title + "\n")
+	buffer.WriteString(fmt.Sprintf("%-10s %6s %10s %6s %7s\n", "Date", "Done", "InProgress", "ToDo", "Unknown"))
+	for _, s := range stats {
+		buffer.WriteString(fmt.Sprintf("%-10s %6d %10d %6d %7d\n", s.Date.Format("2006-01-02"), s.Done, s.InProgress, s.NotDone, s.Unknown))
+	}
 
-		Info.Println("Uploaded to", url)
+	fileName := fmt.Sprintf("cfd_%v_%v.png", name, time.Now().Format("2006-01-02"))
+	if err := images.saveAndUpload(drawCumulativeFlowImage(title, stats), fileName); err != nil {
+		return buffer, err
 	}
 
 	return buffer, nil
 }
 
-// ================================================================================================
-// Http
+// getFlowTimeReport returns the flow times of the workitems under the epic, or returned by the
+// query if epicId is 0, that were completed between from and to
+func getFlowTimeReport(acc, proj, token string, epicId int, queryId string, from, to time.Time) (string, string, []FlowTime, error) {
+	title, name, histories, err := getHistories(NewWork(acc, proj, token), epicId, queryId)
+	if err != nil {
+		return title, name, nil, err
+	}
 
-func showRequest(r *http.Request) {
-	Info.Printf("Request for %s from %s(%s)", r.RequestURI, r.RemoteAddr, r.UserAgent())
+	return title, name, getFlowTimes(histories, from, to), nil
 }
 
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	showRequest(r)
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Welcome to DevOps tools from @abhinaba\nUse /pr and /wit\n"))
+// showFlowTimes shows the lead and cycle time percentiles per workitem type and per assignee
+func showFlowTimes(title, name string, flowTimes []FlowTime, from, to time.Time, images *ImageStore) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(title + "\n")
+	buffer.WriteString(fmt.Sprintf("%v workitems completed between %v and %v\n",
+		len(flowTimes), from.Format("2006-01-02"), to.Format("2006-01-02")))
+
+	byType := getFlowTimeStats(flowTimes, func(f FlowTime) string { return f.WorkItem.Type })
+	byAssignee := getFlowTimeStats(flowTimes, func(f FlowTime) string { return f.WorkItem.AssignedTo })
+
+	buffer.WriteString("\nBy Type (days)\n")
+	writeFlowTimeStats(&buffer, byType)
+	buffer.WriteString("\nBy Assignee (days)\n")
+	writeFlowTimeStats(&buffer, byAssignee)
+
+	fileName := fmt.Sprintf("flowtime_%v_%v.png", name, time.Now().Format("2006-01-02"))
+	if err := images.saveAndUpload(drawFlowTimeImage(title, flowTimes, from, to), fileName); err != nil {
+		return buffer, err
+	}
+
+	return buffer, nil
 }
 
-func prHandler(w http.ResponseWriter, r *http.Request) {
-	showRequest(r)
-	prCount, err := getIntQueryParam("count", w, r, defaultPrCount)
-	if err != nil {
-		Error.Printf("Error!! %v %v\n", r.URL, err)
-		return
+func writeFlowTimeStats(buffer *bytes.Buffer, stats []FlowTimeStat) {
+	buffer.WriteString(fmt.Sprintf("%30s %5s %21s %21s\n", "", "Count", "Lead p50/p85/p95", "Cycle p50/p85/p95"))
+	for _, s := range stats {
+		buffer.WriteString(fmt.Sprintf("%30s %5d %6.1f %6.1f %6.1f  %6.1f %6.1f %6.1f\n",
+			s.Group, s.Count, s.Lead50, s.Lead85, s.Lead95, s.Cycle50, s.Cycle85, s.Cycle95))
 	}
+}
 
-	if prCount > maxPrCount || prCount <= 0 {
-		writeError(w, "Invalid count range")
-		return
+// getWorkload returns the people holding in progress or to do workitems. The workitems are the
+// ones returned by itemQuery, or if that is empty the children of the epics returned by epicQuery.
+func getWorkload(acc, proj, token, epicQuery, itemQuery string) ([]AssigneeStat, error) {
+	q := NewWork(acc, proj, token)
+
+	var items []WorkItem
+	if len(itemQuery) != 0 {
+		Info.Printf("Fetching workitems using query %v\n", itemQuery)
+		wits, err := q.GetWorkitems(itemQuery)
+		if err != nil {
+			return nil, err
+		}
+		items = wits
+	} else {
+		Info.Printf("Fetching epics using query %v\n", epicQuery)
+		epics, err := q.GetWorkitems(epicQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[int]bool)
+		for _, epic := range epics {
+			Info.Printf("Fetching epic %v: %v\n", epic.Id, epic.Title)
+			wits, err := q.loadWorkitems(epic.Id)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, wi := range wits {
+				if wi.Type == "Epic" || seen[wi.Id] {
+					continue
+				}
+				seen[wi.Id] = true
+				items = append(items, wi)
+			}
+		}
 	}
 
-	buffer, err1 := showPrStats(devOpsAccount, devOpsProject, devOpsToken, devOpsRepo, prCount, azStorageAcc, azStorageKey)
-	if err1 != nil {
-		str := fmt.Sprintf("Error fetching pull-request stats: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(str))
+	// Only people holding active work are interesting
+	var people []AssigneeStat
+	for _, p := range getAssigneeStats(items) {
+		if p.InProgress+p.NotDone > 0 {
+			people = append(people, p)
+		}
 	}
 
-	buffer.WriteString(fmt.Sprintf("Processed %v pull-requests\n", prCount))
-	w.WriteHeader(http.StatusOK)
-	w.Write(buffer.Bytes())
+	return people, nil
 }
 
-func witHandler(w http.ResponseWriter, r *http.Request) {
-	showRequest(r)
-	queryId, _ := getStringQueryParam("queryid", w, r, defaultEpicWitQuery)
-	buffer, err := showWorkStats(devOpsAccount, devOpsProject, devOpsToken, azStorageAcc, azStorageKey, queryId)
-	if err != nil {
-		str := fmt.Sprintf("Error fetching work stats: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(str))
-		return
+// showWorkload shows the in progress and to do workitems held by each person
+func showWorkload(people []AssigneeStat, wip int, images *ImageStore) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("%30s %10s %5s\n", "", "InProgress", "ToDo"))
+	for _, p := range people {
+		str := fmt.Sprintf("%30s %10d %5d", p.Name, p.InProgress, p.NotDone)
+		if p.InProgress > wip {
+			str += fmt.Sprintf("  Over WIP limit of %v", wip)
+		}
+		buffer.WriteString(str + "\n")
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(buffer.Bytes())
+	fileName := "workload_" + time.Now().Format("2006-01-02") + ".png"
+	if err := images.saveAndUpload(drawWorkloadImage(people, wip), fileName); err != nil {
+		return buffer, err
+	}
 
+	return buffer, nil
 }
 
-func getIntQueryParam(name string, w http.ResponseWriter, r *http.Request, defaultValue int) (int, error) {
-	i := defaultValue
+// getAudit finds the orphaned workitems in the project and the misparented or inconsistent
+// workitems under the epics returned by epicQuery
+func getAudit(acc, proj, token, epicQuery string) (AuditReport, error) {
+	var report AuditReport
+	q := NewWork(acc, proj, token)
 
-	if keys, ok := r.URL.Query()[name]; ok {
-		if len(keys) > 0 {
-			var err error
-			i, err = strconv.Atoi(keys[0])
-			if err != nil {
-				writeError(w, "Integer param count expected")
-				return i, fmt.Errorf("Integer param count expected")
-			}
+	Info.Println("Fetching workitems not under any epic")
+	orphans, err := q.GetOrphans()
+	if err != nil {
+		return report, err
+	}
+
+	for _, wi := range orphans {
+		report.Orphans = append(report.Orphans, AuditIssue{WorkItem: wi, Problem: "no parent epic"})
+	}
+
+	Info.Printf("Fetching epics using query %v\n", epicQuery)
+	epics, err := q.GetWorkitems(epicQuery)
+	if err != nil {
+		return report, err
+	}
+
+	for _, epic := range epics {
+		Info.Printf("Auditing epic %v: %v\n", epic.Id, epic.Title)
+		items, links, err := q.GetEpicTree(epic.Id)
+		if err != nil {
+			return report, err
 		}
+		auditTree(&report, items, links)
 	}
-	return i, nil
+
+	return report, nil
 }
 
-func getStringQueryParam(name string, w http.ResponseWriter, r *http.Request, defaultValue string) (string, error) {
-	str := defaultValue
+func showAudit(report AuditReport) bytes.Buffer {
+	var buffer bytes.Buffer
+	writeAuditIssues(&buffer, "Orphaned workitems", report.Orphans)
+	writeAuditIssues(&buffer, "Misparented workitems", report.Misparented)
+	writeAuditIssues(&buffer, "Workitems inconsistent with their parent", report.Inconsistent)
 
-	if keys, ok := r.URL.Query()[name]; ok {
-		if len(keys) > 0 {
-			str = keys[0]
-		}
+	return buffer
+}
+
+// getDependencyGraph returns the dependency and related links of the workitems under the epics
+// returned by epicQuery
+func getDependencyGraph(acc, proj, token, epicQuery string) (*DependencyGraph, error) {
+	q := NewWork(acc, proj, token)
+
+	Info.Printf("Fetching epics using query %v\n", epicQuery)
+	epics, err := q.GetWorkitems(epicQuery)
+	if err != nil {
+		return nil, err
 	}
-	return str, nil
+
+	return q.GetDependencyGraph(epics)
 }
 
-func writeError(w http.ResponseWriter, message string) {
-	w.WriteHeader(http.StatusBadRequest)
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(message))
+// showDependencies shows the dependency graph as text, Graphviz DOT or Mermaid
+func showDependencies(g *DependencyGraph, format string, images *ImageStore) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	switch format {
+	case formatDot:
+		writeDependencyDot(&buffer, g)
+	case formatMermaid:
+		writeDependencyMermaid(&buffer, g)
+	default:
+		writeDependencyText(&buffer, g)
+	}
+
+	fileName := "deps_" + time.Now().Format("2006-01-02") + ".png"
+	if err := images.saveAndUpload(drawDependencyImage(g), fileName); err != nil {
+		return buffer, err
+	}
+
+	return buffer, nil
+}
+
+// getChanges returns what changed in the workitems under the epics since the given time
+func getChanges(acc, proj, token, epicQuery string, since time.Time) ([]EpicChanges, error) {
+	q := NewWork(acc, proj, token)
+
+	Info.Printf("Fetching epics using query %v\n", epicQuery)
+	epics, err := q.GetWorkitems(epicQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch each epic in its own go-routine, keeping the order of the query
+	changes := make([]EpicChanges, len(epics))
+	errs := make([]error, len(epics))
+	var wg sync.WaitGroup
+	for i, epic := range epics {
+		wg.Add(1)
+		go func(i int, epic WorkItem) {
+			defer wg.Done()
+			changes[i], errs[i] = NewWork(acc, proj, token).GetEpicChanges(epic, since)
+		}(i, epic)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			Error.Println("Error getting changes for epic", epics[i].Id)
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+func showChanges(changes []EpicChanges, since time.Time, format string) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	if format == formatHTML {
+		err := writeChangesHTML(&buffer, since, changes)
+		return buffer, err
+	}
+
+	writeChangesText(&buffer, since, changes)
+	return buffer, nil
+}
+
+func writeAuditIssues(buffer *bytes.Buffer, title string, issues []AuditIssue) {
+	buffer.WriteString(fmt.Sprintf("%v (%v)\n", title, len(issues)))
+	for _, i := range issues {
+		wi := i.WorkItem
+		str := fmt.Sprintf("  %v: %v [%v %v] (%v) %v", wi.Id, wi.Title, wi.Type, wi.State, wi.AssignedTo, i.Problem)
+		if i.Parent.Id != 0 {
+			str += fmt.Sprintf(", parent %v: %v", i.Parent.Id, i.Parent.Title)
+		}
+		buffer.WriteString(str + "\n")
+	}
+	buffer.WriteString("\n")
+}
+
+func drawBars(buffer *bytes.Buffer, ch rune, count float32) {
+	for i := 0; i < int(count); i++ {
+		buffer.WriteRune(ch)
+	}
+}
+
+// ================================================================================================
+// Sprint
+// getSprintReport returns the workitems of the current sprint of the team and what was carried
+// over from the previous one
+func getSprintReport(acc, proj, token, team string) (SprintStat, error) {
+	it := NewIteration(acc, proj, token, team)
+
+	sprint, previous, err := it.GetCurrentIteration()
+	if err != nil {
+		return SprintStat{}, err
+	}
+
+	Info.Printf("Fetching workitems in iteration %v\n", sprint.Path)
+	ids, err := it.GetIterationWorkitemIds(sprint)
+	if err != nil {
+		return SprintStat{}, err
+	}
+
+	q := NewWork(acc, proj, token)
+	histories, err := q.getHistories(ids)
+	if err != nil {
+		return SprintStat{}, err
+	}
+
+	return getSprintStat(sprint, previous, histories), nil
+}
+
+func showSprintStats(stat SprintStat) bytes.Buffer {
+	var buffer bytes.Buffer
+	sprint := stat.Sprint
+
+	buffer.WriteString(fmt.Sprintf("%v (%v - %v)\n", sprint.Name,
+		sprint.Attributes.StartDate.Format("2006-01-02"), sprint.Attributes.FinishDate.Format("2006-01-02")))
+	buffer.WriteString(fmt.Sprintf("Committed:%v Completed:%v Done:%v Total:%v\n\n",
+		stat.Committed, stat.Completed, stat.Done, len(stat.Items)))
+
+	buffer.WriteString(fmt.Sprintf("%30s %5s %10s %5s %7s\n", "", "ToDo", "InProgress", "Done", "Unknown"))
+	for _, a := range getAssigneeStats(stat.Items) {
+		buffer.WriteString(fmt.Sprintf("%30s %5d %10d %5d %7d\n", a.Name, a.NotDone, a.InProgress, a.Done, a.Unknown))
+	}
+
+	for _, bucket := range []int{StateInProgress, StateNotDone, StateDone, StateUnknown} {
+		var items []WorkItem
+		for _, wi := range stat.Items {
+			if stateBucket(wi.State) == bucket {
+				items = append(items, wi)
+			}
+		}
+		if len(items) == 0 {
+			continue
+		}
+
+		buffer.WriteString(fmt.Sprintf("\n%v\n", bucketName(bucket)))
+		writeWorkItems(&buffer, items)
+	}
+
+	if len(stat.CarryOver) > 0 {
+		buffer.WriteString(fmt.Sprintf("\nCarried over from %v\n", stat.Previous.Name))
+		writeWorkItems(&buffer, stat.CarryOver)
+	}
+
+	return buffer
+}
+
+// getVelocity returns the done workitems and story points of the last count sprints, and whether
+// the team estimates in story points
+func getVelocity(acc, proj, token, team string, count int) ([]VelocityStat, bool, error) {
+	it := NewIteration(acc, proj, token, team)
+	q := NewWork(acc, proj, token)
+
+	sprints, err := it.GetPastIterations(count)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var stats []VelocityStat
+	usePoints := false
+	for _, sprint := range sprints {
+		Info.Printf("Fetching workitems in iteration %v\n", sprint.Path)
+		ids, err := it.GetIterationWorkitemIds(sprint)
+		if err != nil {
+			return nil, false, err
+		}
+
+		var items []WorkItem
+		for _, id := range ids {
+			wi, err := q.GetWorkitem(id)
+			if err != nil {
+				return nil, false, err
+			}
+			items = append(items, wi)
+		}
+
+		stat := getVelocityStat(sprint, items)
+		if stat.Points > 0 {
+			usePoints = true
+		}
+		stats = append(stats, stat)
+	}
+	setRollingAverage(stats, velocityWindow)
+
+	return stats, usePoints, nil
+}
+
+func showVelocity(stats []VelocityStat, usePoints bool, images *ImageStore) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("%30s %10s %5s %6s %6s\n", "", "Finished", "Items", "Points", "Avg"))
+	for _, s := range stats {
+		avg := s.AvgItems
+		if usePoints {
+			avg = s.AvgPoints
+		}
+		buffer.WriteString(fmt.Sprintf("%30s %10s %5d %6v %6.1f\n", s.Sprint.Name,
+			s.Sprint.Attributes.FinishDate.Format("2006-01-02"), s.Items, s.Points, avg))
+	}
+
+	fileName := "velocity_" + time.Now().Format("2006-01-02") + ".png"
+	if err := images.saveAndUpload(drawVelocityImage(stats, usePoints), fileName); err != nil {
+		return buffer, err
+	}
+
+	return buffer, nil
+}
+
+func writeWorkItems(buffer *bytes.Buffer, items []WorkItem) {
+	for _, wi := range items {
+		buffer.WriteString(fmt.Sprintf("  %v: %v [%v] (%v)\n", wi.Id, wi.Title, wi.State, wi.AssignedTo))
+	}
+}
+
+// ================================================================================================
+// PR
+func getPrReport(acc, proj, token, repo string, count int) (PrReport, error) {
+	r := NewRepo(acc, proj, token, repo)
+	return r.GetPullRequestReport(count)
+}
+
+func showPrStats(report PrReport, images *ImageStore) (bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	revStats, max := report.Reviewers, report.MaxReviews
+	barmax := float32(80.0)
+
+	// Output!!
+	buffer.WriteString("\nReviewer Stats\n\n")
+	for _, revStat := range revStats {
+		bar := int((barmax / float32(max)) * float32(revStat.Count))
+		percentage := float32(revStat.Count) / float32(report.Processed) * 100.0
+		buffer.WriteString(fmt.Sprintf("%30s %4d (%4.1f%%) ", revStat.Name, revStat.Count, percentage))
+		buffer.WriteString("[")
+		i := 0
+		for ; i < bar; i++ {
+			buffer.WriteRune('#')
+		}
+
+		for ; i < int(barmax); i++ {
+			buffer.WriteRune('-')
+		}
+		buffer.WriteString("]\n")
+	}
+
+	fileName := "revstat_" + time.Now().Format("2006-01-02") + ".png"
+	if err := images.saveAndUpload(drawPrStatImage(revStats, report.Processed), fileName); err != nil {
+		return buffer, err
+	}
+
+	return buffer, nil
+}
+
+// ================================================================================================
+// Http
+
+func showRequest(r *http.Request) {
+	Info.Printf("Request for %s from %s(%s)", r.RequestURI, r.RemoteAddr, r.UserAgent())
+}
+
+func prHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	prCount, err := getIntQueryParam("count", w, r, defaultPrCount)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	if prCount > maxPrCount || prCount <= 0 {
+		writeError(w, "Invalid count range")
+		return
+	}
+
+	format, err := getReportFormat(w, r)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	report, err := getPrReport(p.Account, p.Project, p.Token, p.Repo, prCount)
+	if err != nil {
+		writeServerError(w, "Error fetching pull-request stats", err)
+		return
+	}
+
+	switch format {
+	case formatJSON:
+		writeJSON(w, r, report)
+		return
+	case formatCSV, formatTSV:
+		writeReportTable(w, r, format, reviewerTable(report))
+		return
+	}
+
+	buffer, err := showPrStats(report, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating pull-request stats", err)
+		return
+	}
+
+	buffer.WriteString(fmt.Sprintf("Processed %v pull-requests\n", report.Processed))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+// prImageHandler renders the reviewer stats image in memory instead of saving and uploading it
+func prImageHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	prCount, err := getIntQueryParam("count", w, r, defaultPrCount)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	if prCount > maxPrCount || prCount <= 0 {
+		writeError(w, "Invalid count range")
+		return
+	}
+
+	report, err := getPrReport(p.Account, p.Project, p.Token, p.Repo, prCount)
+	if err != nil {
+		writeServerError(w, "Error fetching pull-request stats", err)
+		return
+	}
+
+	writePNG(w, r, drawPrStatImage(report.Reviewers, report.Processed), report.GeneratedAt)
+}
+
+// getWorkStatOptions reads the epic query and the options of the workitem stats
+func getWorkStatOptions(w http.ResponseWriter, r *http.Request) (string, WorkStatOptions, error) {
+	queryId, _ := getStringQueryParam("queryid", w, r, requestProfile(r).EpicQuery)
+	weight, _ := getStringQueryParam("weight", w, r, "count")
+	if weight != "count" && weight != "points" {
+		writeError(w, "Invalid weight, use count or points")
+		return queryId, WorkStatOptions{}, fmt.Errorf("Invalid weight %v", weight)
+	}
+
+	forecast, err := getBoolQueryParam("forecast", w, r, false)
+	if err != nil {
+		return queryId, WorkStatOptions{}, err
+	}
+
+	groupBy, _ := getStringQueryParam("groupby", w, r, "epic")
+	if groupBy != "epic" && groupBy != "tag" && groupBy != "area" {
+		writeError(w, "Invalid groupby, use epic, tag or area")
+		return queryId, WorkStatOptions{}, fmt.Errorf("Invalid groupby %v", groupBy)
+	}
+
+	if groupBy != "epic" && (weight != "count" || forecast) {
+		writeError(w, fmt.Sprintf("groupby=%v only supports workitem counts", groupBy))
+		return queryId, WorkStatOptions{}, fmt.Errorf("Invalid groupby %v with weight %v", groupBy, weight)
+	}
+
+	area, _ := getStringQueryParam("area", w, r, "")
+	stale, err := getIntQueryParam("stale", w, r, staleDays)
+	if err != nil {
+		return queryId, WorkStatOptions{}, err
+	}
+
+	if stale <= 0 {
+		writeError(w, "Invalid stale days")
+		return queryId, WorkStatOptions{}, fmt.Errorf("Invalid stale days %v", stale)
+	}
+
+	opts := WorkStatOptions{
+		Weighted: weight == "points",
+		Forecast: forecast,
+		GroupBy:  groupBy,
+		Area:     area,
+		Stale:    stale,
+	}
+
+	return queryId, opts, nil
+}
+
+func witHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	queryId, opts, err := getWorkStatOptions(w, r)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	format, err := getReportFormat(w, r)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	epicStats, err := getEpicStats(p.Account, p.Project, p.Token, queryId, opts)
+	if err != nil {
+		writeServerError(w, "Error fetching work stats", err)
+		return
+	}
+
+	switch format {
+	case formatJSON:
+		writeJSON(w, r, getWitReport(epicStats, queryId, opts))
+		return
+	case formatCSV, formatTSV:
+		if report := getWitReport(epicStats, queryId, opts); opts.GroupBy != "epic" {
+			writeReportTable(w, r, format, groupStatTable(report.Groups))
+		} else {
+			writeReportTable(w, r, format, epicStatTable(report.Epics))
+		}
+		return
+	}
+
+	buffer, err := showWorkStats(epicStats, opts, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating work stats", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+
+}
+
+// witImageHandler renders the workitem stats image in memory instead of saving and uploading it
+func witImageHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	queryId, opts, err := getWorkStatOptions(w, r)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	epicStats, err := getEpicStats(p.Account, p.Project, p.Token, queryId, opts)
+	if err != nil {
+		writeServerError(w, "Error fetching work stats", err)
+		return
+	}
+
+	report := getWitReport(epicStats, queryId, opts)
+	switch opts.GroupBy {
+	case "tag":
+		writePNG(w, r, drawGroupStatImage("Tag Status", report.Groups), report.GeneratedAt)
+	case "area":
+		writePNG(w, r, drawGroupStatImage("Area Status", report.Groups), report.GeneratedAt)
+	default:
+		writePNG(w, r, drawWitStatImage(report.Epics, opts.Weighted), report.GeneratedAt)
+	}
+}
+
+func burnHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	epicId, err := getIntQueryParam("epic", w, r, 0)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	if epicId <= 0 {
+		writeError(w, "Epic id expected")
+		return
+	}
+
+	days, err := getIntQueryParam("days", w, r, defaultBurnDays)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	if days > maxBurnDays || days <= 0 {
+		writeError(w, "Invalid days range")
+		return
+	}
+
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	epic, stats, err := getBurnStats(p.Account, p.Project, p.Token, epicId, days)
+	if err != nil {
+		writeServerError(w, "Error fetching burn stats", err)
+		return
+	}
+
+	if format != formatText {
+		writeReportTable(w, r, format, dailyStatTable(stats))
+		return
+	}
+
+	buffer, err := showBurnStats(epic, stats, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating burn stats", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func cfdHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	epicId, err := getIntQueryParam("epic", w, r, 0)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	queryId, _ := getStringQueryParam("queryid", w, r, "")
+	if epicId <= 0 && len(queryId) == 0 {
+		writeError(w, "Epic id or query id expected")
+		return
+	}
+
+	from, to, err := getDateRangeQueryParams(w, r)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	title, name, stats, err := getCumulativeFlow(p.Account, p.Project, p.Token, epicId, queryId, from, to)
+	if err != nil {
+		writeServerError(w, "Error fetching cumulative flow", err)
+		return
+	}
+
+	if format != formatText {
+		writeReportTable(w, r, format, dailyStatTable(stats))
+		return
+	}
+
+	buffer, err := showCumulativeFlow(title, name, stats, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating cumulative flow", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func flowTimeHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	epicId, err := getIntQueryParam("epic", w, r, 0)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	queryId, _ := getStringQueryParam("queryid", w, r, "")
+	if epicId <= 0 && len(queryId) == 0 {
+		writeError(w, "Epic id or query id expected")
+		return
+	}
+
+	from, to, err := getDateRangeQueryParams(w, r)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	title, name, flowTimes, err := getFlowTimeReport(p.Account, p.Project, p.Token, epicId, queryId, from, to)
+	if err != nil {
+		writeServerError(w, "Error fetching flow times", err)
+		return
+	}
+
+	if format != formatText {
+		writeReportTable(w, r, format, flowTimeTable(flowTimes))
+		return
+	}
+
+	buffer, err := showFlowTimes(title, name, flowTimes, from, to, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating flow times", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func sprintHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	team, _ := getStringQueryParam("team", w, r, p.Team)
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	stat, err := getSprintReport(p.Account, p.Project, p.Token, team)
+	if err != nil {
+		writeServerError(w, "Error fetching sprint stats", err)
+		return
+	}
+
+	if format != formatText {
+		writeReportTable(w, r, format, sprintTable(stat))
+		return
+	}
+
+	buffer := showSprintStats(stat)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func velocityHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	count, err := getIntQueryParam("count", w, r, defaultSprintCount)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	if count > maxSprintCount || count <= 0 {
+		writeError(w, "Invalid count range")
+		return
+	}
+
+	team, _ := getStringQueryParam("team", w, r, p.Team)
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	stats, usePoints, err := getVelocity(p.Account, p.Project, p.Token, team, count)
+	if err != nil {
+		writeServerError(w, "Error fetching velocity", err)
+		return
+	}
+
+	if format != formatText {
+		writeReportTable(w, r, format, velocityTable(stats))
+		return
+	}
+
+	buffer, err := showVelocity(stats, usePoints, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating velocity", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func peopleHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	epicQuery, _ := getStringQueryParam("queryid", w, r, p.EpicQuery)
+	itemQuery, _ := getStringQueryParam("itemqueryid", w, r, "")
+	wip, err := getIntQueryParam("wip", w, r, wipLimit)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	if wip <= 0 {
+		writeError(w, "Invalid wip limit")
+		return
+	}
+
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	people, err := getWorkload(p.Account, p.Project, p.Token, epicQuery, itemQuery)
+	if err != nil {
+		writeServerError(w, "Error fetching workload", err)
+		return
+	}
+
+	if format != formatText {
+		writeReportTable(w, r, format, assigneeTable(people, wip))
+		return
+	}
+
+	buffer, err := showWorkload(people, wip, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating workload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+// queryHandler runs a WIQL query POSTed in the body (or the wiql form field) or a named template
+// and returns the workitems as a table, json, csv or tsv
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	format, err := getReportFormat(w, r)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	var query string
+	if name, _ := getStringQueryParam("template", w, r, ""); len(name) != 0 {
+		var ok bool
+		if query, ok = wiqlTemplate(name); !ok {
+			writeError(w, fmt.Sprintf("Unknown template %v, use one of %v", name, templateNames()))
+			return
+		}
+	} else if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxQueryLength)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			query = r.FormValue("wiql")
+		} else {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, "Error reading query")
+				return
+			}
+			query = string(body)
+		}
+	} else {
+		writeError(w, fmt.Sprintf("POST a WIQL query or use template=%v", templateNames()))
+		return
+	}
+
+	if err := validateWiql(query); err != nil {
+		writeError(w, err.Error())
+		return
+	}
+
+	q := NewWork(p.Account, p.Project, p.Token)
+	items, err := q.RunQuery(query)
+	if err != nil {
+		writeServerError(w, "Error running query", err)
+		return
+	}
+
+	switch format {
+	case formatJSON:
+		if items == nil {
+			items = []WorkItem{}
+		}
+		writeJSON(w, r, items)
+	case formatCSV, formatTSV:
+		writeReportTable(w, r, format, workItemTable(items))
+	default:
+		var buffer bytes.Buffer
+		writeWorkItemsTable(&buffer, items)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write(buffer.Bytes())
+	}
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	queryId, _ := getStringQueryParam("queryid", w, r, p.EpicQuery)
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	report, err := getAudit(p.Account, p.Project, p.Token, queryId)
+	if err != nil {
+		writeServerError(w, "Error auditing workitems", err)
+		return
+	}
+
+	if format != formatText {
+		writeReportTable(w, r, format, auditTable(report))
+		return
+	}
+
+	buffer := showAudit(report)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func depsHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	queryId, _ := getStringQueryParam("queryid", w, r, p.EpicQuery)
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV, formatDot, formatMermaid)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	g, err := getDependencyGraph(p.Account, p.Project, p.Token, queryId)
+	if err != nil {
+		writeServerError(w, "Error fetching dependencies", err)
+		return
+	}
+
+	if format == formatCSV || format == formatTSV {
+		writeReportTable(w, r, format, dependencyTable(g))
+		return
+	}
+
+	buffer, err := showDependencies(g, format, p.Images)
+	if err != nil {
+		writeServerError(w, "Error generating dependencies", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	showRequest(r)
+	p := requestProfile(r)
+	queryId, _ := getStringQueryParam("queryid", w, r, p.EpicQuery)
+	format, err := getFormat(w, r, formatText, formatCSV, formatTSV, formatHTML)
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	since, err := getTimeQueryParam("since", w, r, time.Now().AddDate(0, 0, -1))
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		return
+	}
+
+	if since.After(time.Now()) {
+		writeError(w, "since is in the future")
+		return
+	}
+
+	changes, err := getChanges(p.Account, p.Project, p.Token, queryId, since)
+	if err != nil {
+		writeServerError(w, "Error fetching changes", err)
+		return
+	}
+
+	if format == formatCSV || format == formatTSV {
+		writeReportTable(w, r, format, changesTable(changes))
+		return
+	}
+
+	buffer, err := showChanges(changes, since, format)
+	if err != nil {
+		writeServerError(w, "Error generating changes", err)
+		return
+	}
+
+	if format == formatHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func getIntQueryParam(name string, w http.ResponseWriter, r *http.Request, defaultValue int) (int, error) {
+	i := defaultValue
+
+	if keys, ok := r.URL.Query()[name]; ok {
+		if len(keys) > 0 && len(keys[0]) != 0 {
+			var err error
+			i, err = strconv.Atoi(keys[0])
+			if err != nil {
+				writeError(w, "Integer param count expected")
+				return i, fmt.Errorf("Integer param count expected")
+			}
+		}
+	}
+	return i, nil
+}
+
+func getBoolQueryParam(name string, w http.ResponseWriter, r *http.Request, defaultValue bool) (bool, error) {
+	b := defaultValue
+
+	if keys, ok := r.URL.Query()[name]; ok {
+		if len(keys) > 0 && len(keys[0]) != 0 {
+			var err error
+			b, err = strconv.ParseBool(keys[0])
+			if err != nil {
+				writeError(w, "Boolean param expected")
+				return b, fmt.Errorf("Boolean param expected")
+			}
+		}
+	}
+	return b, nil
+}
+
+func getStringQueryParam(name string, w http.ResponseWriter, r *http.Request, defaultValue string) (string, error) {
+	str := defaultValue
+
+	if keys, ok := r.URL.Query()[name]; ok {
+		if len(keys) > 0 {
+			str = keys[0]
+		}
+	}
+	return str, nil
+}
+
+// getDateQueryParam parses a date in the form YYYY-MM-DD
+func getDateQueryParam(name string, w http.ResponseWriter, r *http.Request, defaultValue time.Time) (time.Time, error) {
+	t := defaultValue
+
+	if keys, ok := r.URL.Query()[name]; ok {
+		if len(keys) > 0 && len(keys[0]) != 0 {
+			var err error
+			t, err = time.ParseInLocation("2006-01-02", keys[0], time.Local)
+			if err != nil {
+				writeError(w, "Date param expected as YYYY-MM-DD")
+				return t, fmt.Errorf("Date param expected as YYYY-MM-DD")
+			}
+		}
+	}
+	return t, nil
+}
+
+// getTimeQueryParam parses a time either as RFC3339 or a YYYY-MM-DD date
+func getTimeQueryParam(name string, w http.ResponseWriter, r *http.Request, defaultValue time.Time) (time.Time, error) {
+	t := defaultValue
+
+	if keys, ok := r.URL.Query()[name]; ok {
+		if len(keys) > 0 && len(keys[0]) != 0 {
+			var err error
+			t, err = time.Parse(time.RFC3339, keys[0])
+			if err != nil {
+				t, err = time.ParseInLocation("2006-01-02", keys[0], time.Local)
+			}
+			if err != nil {
+				writeError(w, "Time param expected as RFC3339 or YYYY-MM-DD")
+				return t, fmt.Errorf("Time param expected as RFC3339 or YYYY-MM-DD")
+			}
+		}
+	}
+	return t, nil
+}
+
+// getDateRangeQueryParams reads the from and to params, defaulting to the last defaultBurnDays days.
+// The to date is inclusive.
+func getDateRangeQueryParams(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, error) {
+	now := time.Now()
+	from, err := getDateQueryParam("from", w, r, now.AddDate(0, 0, -defaultBurnDays))
+	if err != nil {
+		return from, now, err
+	}
+
+	to, err := getDateQueryParam("to", w, r, now)
+	if err != nil {
+		return from, to, err
+	}
+
+	// A date given for to includes the whole day, an empty one is the default of now
+	if keys, ok := r.URL.Query()["to"]; ok && len(keys[0]) != 0 {
+		to = to.AddDate(0, 0, 1).Add(-time.Second)
+	}
+
+	if !from.Before(to) || to.Sub(from) > maxBurnDays*24*time.Hour {
+		writeError(w, "Invalid date range")
+		return from, to, fmt.Errorf("Invalid date range")
+	}
+
+	return from, to, nil
+}
+
+// getReportFormat returns the format asked for with the format param, or else the Accept header,
+// defaulting to text
+func getReportFormat(w http.ResponseWriter, r *http.Request) (string, error) {
+	return getFormat(w, r, formatText, formatJSON, formatCSV, formatTSV)
+}
+
+// getFormat returns the format asked for with the format param, which must be one of formats, or
+// else the first of formats in the Accept header, defaulting to text
+func getFormat(w http.ResponseWriter, r *http.Request, formats ...string) (string, error) {
+	if format := r.URL.Query().Get("format"); len(format) != 0 {
+		if contains(formats, format) {
+			return format, nil
+		}
+		writeError(w, "Invalid format, use "+strings.Join(formats, ", "))
+		return format, fmt.Errorf("Invalid format %v", format)
+	}
+
+	if format := acceptedFormat(r); contains(formats, format) {
+		return format, nil
+	}
+	return formatText, nil
+}
+
+// acceptedFormat returns the first report format in the Accept header, text if there is none
+func acceptedFormat(r *http.Request) string {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		switch strings.TrimSpace(strings.Split(accept, ";")[0]) {
+		case "application/json":
+			return formatJSON
+		case "text/csv":
+			return formatCSV
+		case "text/tab-separated-values":
+			return formatTSV
+		}
+	}
+	return formatText
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
+
+// writePNG streams the image, letting clients and proxies cache it for imageMaxAge
+func writePNG(w http.ResponseWriter, r *http.Request, img image.Image, generatedAt time.Time) {
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buffer.Len()))
+	w.Header().Set("Cache-Control", fmt.Sprintf("%v, max-age=%v", cacheScope(), int(imageMaxAge.Seconds())))
+	w.Header().Set("Last-Modified", generatedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Expires", generatedAt.Add(imageMaxAge).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func writeReportTable(w http.ResponseWriter, r *http.Request, format string, table reportTable) {
+	var buffer bytes.Buffer
+	if err := writeDelimited(&buffer, format, table); err != nil {
+		Error.Printf("Error!! %v %v\n", r.URL, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if format == formatTSV {
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
+
+func writeError(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(message))
+}
+
+// writeServerError tells the client what failed along with the error of Azure DevOps or of
+// generating the report
+func writeServerError(w http.ResponseWriter, message string, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(fmt.Sprintf("%v: %v", message, err)))
 }
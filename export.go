@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"time"
+)
+
+// Report formats returned by getReportFormat and getFormat
+const (
+	formatText    = "text"
+	formatJSON    = "json"
+	formatCSV     = "csv"
+	formatTSV     = "tsv"
+	formatHTML    = "html"    // changes only
+	formatDot     = "dot"     // dependencies only
+	formatMermaid = "mermaid" // dependencies only
+)
+
+// reportTable is a report flattened into rows for csv and tsv, with the column names as the header row
+type reportTable struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// writeDelimited writes the table as csv, or as tsv when the format is tsv
+func writeDelimited(buffer *bytes.Buffer, format string, table reportTable) error {
+	w := csv.NewWriter(buffer)
+	if format == formatTSV {
+		w.Comma = '\t'
+	}
+
+	w.Write(table.Columns)
+	for _, row := range table.Rows {
+		w.Write(row)
+	}
+	w.Flush()
+
+	return w.Error()
+}
+
+// formatDate leaves zero dates empty so they show up as blank cells
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+func reviewerTable(report PrReport) reportTable {
+	table := reportTable{Columns: []string{"Name", "Count", "Percentage"}}
+	for _, r := range report.Reviewers {
+		percentage := float64(r.Count) / float64(report.Processed) * 100.0
+		table.Rows = append(table.Rows, []string{r.Name, strconv.Itoa(r.Count), strconv.FormatFloat(percentage, 'f', 1, 64)})
+	}
+	return table
+}
+
+func epicStatTable(epicStats []EpicStat) reportTable {
+	table := reportTable{Columns: []string{"Id", "Title", "AssignedTo",
+		"Done", "InProgress", "NotDone", "Unknown",
+		"DonePoints", "InProgressPoints", "NotDonePoints", "UnknownPoints", "RemainingWork",
+		"Forecast50", "Forecast85", "Forecast95", "NeedsAttention"}}
+
+	for _, e := range epicStats {
+		row := []string{strconv.Itoa(e.Epic.Id), e.Epic.Title, e.Epic.AssignedTo,
+			strconv.Itoa(e.Done), strconv.Itoa(e.InProgress), strconv.Itoa(e.NotDone), strconv.Itoa(e.Unknown),
+			formatValue(e.DonePoints), formatValue(e.InProgressPoints), formatValue(e.NotDonePoints), formatValue(e.UnknownPoints),
+			formatValue(e.RemainingWork)}
+
+		var f Forecast
+		if e.Forecast != nil {
+			f = *e.Forecast
+		}
+		row = append(row, formatDate(f.P50), formatDate(f.P85), formatDate(f.P95), strconv.Itoa(len(e.Attention)))
+
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
+
+func groupStatTable(groupStats []GroupStat) reportTable {
+	table := reportTable{Columns: []string{"Name", "Done", "InProgress", "NotDone", "Unknown"}}
+	for _, g := range groupStats {
+		table.Rows = append(table.Rows, []string{g.Name,
+			strconv.Itoa(g.Done), strconv.Itoa(g.InProgress), strconv.Itoa(g.NotDone), strconv.Itoa(g.Unknown)})
+	}
+	return table
+}
+
+func dailyStatTable(stats []DailyStat) reportTable {
+	table := reportTable{Columns: []string{"Date", "Done", "InProgress", "NotDone", "Unknown", "Scope", "Remaining"}}
+	for _, s := range stats {
+		table.Rows = append(table.Rows, []string{formatDate(s.Date),
+			strconv.Itoa(s.Done), strconv.Itoa(s.InProgress), strconv.Itoa(s.NotDone), strconv.Itoa(s.Unknown),
+			strconv.Itoa(s.Total()), strconv.Itoa(s.Total() - s.Done)})
+	}
+	return table
+}
+
+// flowTimeTable has a row per completed workitem, CycleDays is empty if it was never in progress
+func flowTimeTable(flowTimes []FlowTime) reportTable {
+	table := reportTable{Columns: []string{"Id", "Type", "Title", "AssignedTo",
+		"Created", "Started", "Completed", "LeadDays", "CycleDays"}}
+
+	for _, f := range flowTimes {
+		wi := f.WorkItem
+		cycle := ""
+		if !f.Started.IsZero() {
+			cycle = strconv.FormatFloat(f.CycleTime().Hours()/24, 'f', 1, 64)
+		}
+		table.Rows = append(table.Rows, []string{strconv.Itoa(wi.Id), wi.Type, wi.Title, wi.AssignedTo,
+			formatDate(f.Created), formatDate(f.Started), formatDate(f.Completed),
+			strconv.FormatFloat(f.LeadTime().Hours()/24, 'f', 1, 64), cycle})
+	}
+	return table
+}
+
+func assigneeTable(people []AssigneeStat, wip int) reportTable {
+	table := reportTable{Columns: []string{"Name", "InProgress", "NotDone", "OverWipLimit"}}
+	for _, p := range people {
+		table.Rows = append(table.Rows, []string{p.Name,
+			strconv.Itoa(p.InProgress), strconv.Itoa(p.NotDone), strconv.FormatBool(p.InProgress > wip)})
+	}
+	return table
+}
+
+// sprintTable has a row per workitem in the sprint followed by the ones carried over
+func sprintTable(stat SprintStat) reportTable {
+	table := reportTable{Columns: []string{"Sprint", "Id", "Type", "State", "Bucket", "Title", "AssignedTo", "CarriedOver"}}
+
+	add := func(items []WorkItem, carriedOver bool) {
+		for _, wi := range items {
+			table.Rows = append(table.Rows, []string{stat.Sprint.Name, strconv.Itoa(wi.Id), wi.Type, wi.State,
+				bucketName(stateBucket(wi.State)), wi.Title, wi.AssignedTo, strconv.FormatBool(carriedOver)})
+		}
+	}
+	add(stat.Items, false)
+	add(stat.CarryOver, true)
+
+	return table
+}
+
+func velocityTable(stats []VelocityStat) reportTable {
+	table := reportTable{Columns: []string{"Sprint", "Start", "Finish", "Items", "Points", "AvgItems", "AvgPoints"}}
+	for _, s := range stats {
+		table.Rows = append(table.Rows, []string{s.Sprint.Name,
+			formatDate(s.Sprint.Attributes.StartDate), formatDate(s.Sprint.Attributes.FinishDate),
+			strconv.Itoa(s.Items), formatValue(s.Points),
+			strconv.FormatFloat(s.AvgItems, 'f', 1, 64), strconv.FormatFloat(s.AvgPoints, 'f', 1, 64)})
+	}
+	return table
+}
+
+func auditTable(report AuditReport) reportTable {
+	table := reportTable{Columns: []string{"Category", "Id", "Type", "State", "Title", "AssignedTo",
+		"Problem", "ParentId", "ParentTitle"}}
+
+	add := func(category string, issues []AuditIssue) {
+		for _, i := range issues {
+			wi := i.WorkItem
+			parentId := ""
+			if i.Parent.Id != 0 {
+				parentId = strconv.Itoa(i.Parent.Id)
+			}
+			table.Rows = append(table.Rows, []string{category, strconv.Itoa(wi.Id), wi.Type, wi.State, wi.Title, wi.AssignedTo,
+				i.Problem, parentId, i.Parent.Title})
+		}
+	}
+	add("orphaned", report.Orphans)
+	add("misparented", report.Misparented)
+	add("inconsistent", report.Inconsistent)
+
+	return table
+}
+
+func dependencyTable(g *DependencyGraph) reportTable {
+	table := reportTable{Columns: []string{"From", "FromTitle", "FromState", "To", "ToTitle", "ToState", "Link", "Blocking"}}
+	for _, e := range g.Edges {
+		from, to := g.Nodes[e.From].WorkItem, g.Nodes[e.To].WorkItem
+		link := "dependency"
+		if e.Related {
+			link = "related"
+		}
+		table.Rows = append(table.Rows, []string{strconv.Itoa(from.Id), from.Title, from.State,
+			strconv.Itoa(to.Id), to.Title, to.State, link, strconv.FormatBool(g.Blocking(e))})
+	}
+	return table
+}
+
+// changesTable has a row per field change, ordered like the digest
+func changesTable(changes []EpicChanges) reportTable {
+	table := reportTable{Columns: []string{"Epic", "EpicTitle", "Id", "Title", "Date", "Field", "Old", "New"}}
+	for _, ec := range changes {
+		for _, item := range ec.Items {
+			for _, c := range item.Changes {
+				table.Rows = append(table.Rows, []string{strconv.Itoa(ec.Epic.Id), ec.Epic.Title,
+					strconv.Itoa(item.WorkItem.Id), item.WorkItem.Title, c.Date.Format(time.RFC3339), c.Field, c.Old, c.New})
+			}
+		}
+	}
+	return table
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	throughputWeeks = 12    // weeks of history the throughput is sampled from
+	forecastTrials  = 10000 // number of Monte Carlo simulations to run
+	maxForecastWeek = 520   // give up simulating a trial after this many weeks
+)
+
+// Forecast is when the remaining workitems of an epic are likely to be done
+type Forecast struct {
+	Remaining  int   `json:"remaining"`
+	Throughput []int `json:"throughput"` // workitems done in each of the past weeks, oldest first
+
+	// Dates by which the work is done with 50, 85 and 95% likelihood. These are zero
+	// when there is no throughput to forecast from.
+	P50 time.Time `json:"p50"`
+	P85 time.Time `json:"p85"`
+	P95 time.Time `json:"p95"`
+}
+
+func (f Forecast) Valid() bool {
+	return !f.P50.IsZero()
+}
+
+// getWeeklyThroughput counts the workitems that got done in each of the past weeks before now
+func getWeeklyThroughput(histories []WorkItemHistory, weeks int, now time.Time) []int {
+	from := now.AddDate(0, 0, -7*weeks)
+	throughput := make([]int, weeks)
+	for _, f := range getFlowTimes(histories, from, now) {
+		week := int(f.Completed.Sub(from).Hours() / (24 * 7))
+		if week >= weeks {
+			week = weeks - 1
+		}
+		throughput[week]++
+	}
+
+	return throughput
+}
+
+// forecastCompletion runs Monte Carlo trials that each pick a random past week's throughput for
+// every future week till the remaining workitems are done, and takes percentiles of the outcome
+func forecastCompletion(remaining int, throughput []int, now time.Time) Forecast {
+	f := Forecast{Remaining: remaining, Throughput: throughput}
+	if remaining <= 0 {
+		f.P50, f.P85, f.P95 = now, now, now
+		return f
+	}
+
+	total := 0
+	for _, t := range throughput {
+		total += t
+	}
+	if total == 0 {
+		return f
+	}
+
+	rnd := rand.New(rand.NewSource(now.UnixNano()))
+	weeks := make([]int, forecastTrials)
+	for i := range weeks {
+		done, week := 0, 0
+		for done < remaining && week < maxForecastWeek {
+			done += throughput[rnd.Intn(len(throughput))]
+			week++
+		}
+		weeks[i] = week
+	}
+	sort.Ints(weeks)
+
+	at := func(p int) time.Time {
+		return now.AddDate(0, 0, 7*weeks[(len(weeks)*p)/100])
+	}
+	f.P50, f.P85, f.P95 = at(50), at(85), at(95)
+
+	return f
+}
@@ -0,0 +1,297 @@
+package main
+
+// Docs
+// https://docs.microsoft.com/en-us/rest/api/azure/devops/wit/revisions/list?view=azure-devops-rest-4.1
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+type WorkItemRevisionsResponse struct {
+	Count     int                `json:"count"`
+	Revisions []WorkItemRevision `json:"value"`
+}
+
+type WorkItemRevision struct {
+	Id        int    `json:"id"`
+	Rev       int    `json:"rev"`
+	WitFields Fields `json:"fields"`
+}
+
+// WorkItemHistory is every revision of a workitem, oldest first
+type WorkItemHistory struct {
+	Id        int
+	Revisions []WorkItem
+}
+
+// DailyStat is the count of workitems in each state bucket at the end of a day
+type DailyStat struct {
+	Date       time.Time
+	Done       int
+	InProgress int
+	NotDone    int
+	Unknown    int
+}
+
+func (d DailyStat) Total() int {
+	return d.Done + d.InProgress + d.NotDone + d.Unknown
+}
+
+// Revisions are returned a page at a time
+const revisionPageSize = 200
+
+// GetWorkitemHistory fetches every revision of the workitem, following the pages of revisions
+func (r *AzureDevopsWit) GetWorkitemHistory(witId int) (WorkItemHistory, error) {
+	history := WorkItemHistory{Id: witId}
+	for skip := 0; ; skip += revisionPageSize {
+		URL := fmt.Sprintf("_apis/wit/workitems/%v/revisions?$top=%v&$skip=%v&api-version=4.1", witId, revisionPageSize, skip)
+
+		req, err := r.client.NewRequest("GET", URL, nil)
+		if err != nil {
+			return WorkItemHistory{}, err
+		}
+
+		var response WorkItemRevisionsResponse
+		_, err = r.client.Execute(req, &response)
+		if err != nil {
+			return WorkItemHistory{}, err
+		}
+
+		for _, rev := range response.Revisions {
+			history.Revisions = append(history.Revisions, toWorkItem(witId, rev.WitFields))
+		}
+
+		if len(response.Revisions) < revisionPageSize {
+			return history, nil
+		}
+	}
+}
+
+// GetEpicHistory fetches the history of every workitem under parentEpic, skipping the epics
+func (r *AzureDevopsWit) GetEpicHistory(parentEpic int) ([]WorkItemHistory, error) {
+	ids, err := r.loadWorkitemIds(parentEpic)
+	if err != nil {
+		return nil, err
+	}
+
+	histories, err := r.getHistories(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []WorkItemHistory
+	for _, h := range histories {
+		if h.Latest().Type == "Epic" { // don't count the epics
+			continue
+		}
+		children = append(children, h)
+	}
+
+	return children, nil
+}
+
+// GetQueryHistory fetches the history of every workitem returned by a saved query
+func (r *AzureDevopsWit) GetQueryHistory(queryId string) ([]WorkItemHistory, error) {
+	ids, err := r.loadQueryIds(queryId)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.getHistories(ids)
+}
+
+func (r *AzureDevopsWit) getHistories(ids []int) ([]WorkItemHistory, error) {
+	var histories []WorkItemHistory
+	for _, id := range ids {
+		h, err := r.GetWorkitemHistory(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(h.Revisions) == 0 {
+			continue
+		}
+
+		histories = append(histories, h)
+	}
+
+	return histories, nil
+}
+
+// Latest returns the current revision of the workitem
+func (h WorkItemHistory) Latest() WorkItem {
+	return h.Revisions[len(h.Revisions)-1]
+}
+
+// At returns the revision that was current at time t, false if the workitem did not exist yet
+func (h WorkItemHistory) At(t time.Time) (WorkItem, bool) {
+	var wi WorkItem
+	found := false
+	for _, rev := range h.Revisions {
+		if rev.ChangedDate.After(t) {
+			break
+		}
+		wi = rev
+		found = true
+	}
+
+	return wi, found
+}
+
+// Created returns when the first revision of the workitem was made
+func (h WorkItemHistory) Created() time.Time {
+	return h.Revisions[0].ChangedDate
+}
+
+// getDailyStats replays the histories and counts the state buckets at the end of each day between from and to
+func getDailyStats(histories []WorkItemHistory, from, to time.Time) []DailyStat {
+	var stats []DailyStat
+
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local)
+	for !day.After(to) {
+		end := day.AddDate(0, 0, 1)
+		stat := DailyStat{Date: day}
+		for _, h := range histories {
+			wi, ok := h.At(end)
+			if !ok {
+				continue
+			}
+
+			switch stateBucket(wi.State) {
+			case StateNotDone:
+				stat.NotDone++
+			case StateInProgress:
+				stat.InProgress++
+			case StateDone:
+				stat.Done++
+			default:
+				stat.Unknown++
+			}
+		}
+
+		stats = append(stats, stat)
+		day = end
+	}
+
+	return stats
+}
+
+// FlowTime is how long a completed workitem took to get done
+type FlowTime struct {
+	WorkItem  WorkItem // the current revision
+	Created   time.Time
+	Started   time.Time // zero if the workitem was never in progress
+	Completed time.Time
+}
+
+// LeadTime is the time from creation to done
+func (f FlowTime) LeadTime() time.Duration {
+	return f.Completed.Sub(f.Created)
+}
+
+// CycleTime is the time from first being in progress to done, 0 if it was never in progress
+func (f FlowTime) CycleTime() time.Duration {
+	if f.Started.IsZero() {
+		return 0
+	}
+	return f.Completed.Sub(f.Started)
+}
+
+// FlowTimeStat is the lead and cycle time percentiles (in days) of a group of workitems
+type FlowTimeStat struct {
+	Group   string
+	Count   int
+	Lead50  float64
+	Lead85  float64
+	Lead95  float64
+	Cycle50 float64
+	Cycle85 float64
+	Cycle95 float64
+}
+
+// getFlowTimes returns the flow time of the workitems that got done between from and to.
+// Removed workitems are not counted as they never got delivered.
+func getFlowTimes(histories []WorkItemHistory, from, to time.Time) []FlowTime {
+	var flowTimes []FlowTime
+	for _, h := range histories {
+		latest := h.Latest()
+		if stateBucket(latest.State) != StateDone || latest.State == "Removed" {
+			continue
+		}
+
+		f := FlowTime{WorkItem: latest, Created: h.Created()}
+		prev := StateUnknown
+		for _, rev := range h.Revisions {
+			bucket := stateBucket(rev.State)
+			if bucket == StateInProgress && f.Started.IsZero() {
+				f.Started = rev.ChangedDate
+			}
+
+			// a workitem can get re-opened, so the last time it moved to done counts
+			if bucket == StateDone && prev != StateDone {
+				f.Completed = rev.ChangedDate
+			}
+			prev = bucket
+		}
+
+		if f.Completed.Before(from) || f.Completed.After(to) {
+			continue
+		}
+
+		flowTimes = append(flowTimes, f)
+	}
+
+	return flowTimes
+}
+
+// getFlowTimeStats groups the flow times using key and computes the percentiles of each group
+func getFlowTimeStats(flowTimes []FlowTime, key func(FlowTime) string) []FlowTimeStat {
+	leads := make(map[string][]float64)
+	cycles := make(map[string][]float64)
+	for _, f := range flowTimes {
+		k := key(f)
+		leads[k] = append(leads[k], f.LeadTime().Hours()/24)
+		if !f.Started.IsZero() {
+			cycles[k] = append(cycles[k], f.CycleTime().Hours()/24)
+		}
+	}
+
+	var stats []FlowTimeStat
+	for k, l := range leads {
+		c := cycles[k]
+		stats = append(stats, FlowTimeStat{
+			Group:   k,
+			Count:   len(l),
+			Lead50:  percentile(l, 50),
+			Lead85:  percentile(l, 85),
+			Lead95:  percentile(l, 95),
+			Cycle50: percentile(c, 50),
+			Cycle85: percentile(c, 85),
+			Cycle95: percentile(c, 95),
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Group < stats[j].Group
+	})
+
+	return stats
+}
+
+// percentile uses the nearest-rank method, 0 for no values
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/llgcode/draw2d"
@@ -16,13 +18,14 @@ var (
 	WitInProgressColor = color.RGBA{0xff, 0xff, 0xa0, 0xff} // yellowish
 	WitDoneColor       = color.RGBA{0, 0xad, 0, 0xff}       // greenish
 	WitUnKnownColor    = color.RGBA{0xaa, 0, 0xff, 0xff}    // purplish
+	WitForecastColor   = color.RGBA{0x40, 0x80, 0xff, 0xff} // blueish
+	WitAttentionColor  = color.RGBA{0xff, 0xc0, 0, 0xff}    // amber
 )
 
 // ================================================================================================
 // PR related images
-func savePrStatImage(reviewers []ReviewerStat, prCount int, fileName string) error {
-	Info.Println("Generating image ", fileName)
-
+// drawPrStatImage draws the review count of each reviewer as bars
+func drawPrStatImage(reviewers []ReviewerStat, prCount int) *image.RGBA {
 	nReviewers := len(reviewers)
 	w := 1000.0
 
@@ -80,27 +83,20 @@ func savePrStatImage(reviewers []ReviewerStat, prCount int, fileName string) err
 
 	drawFooter(gc, w, h)
 
-	err := draw2dimg.SaveToPngFile(fileName, dest)
-	if err != nil {
-		return err
-	}
-
-	Info.Println("Generated", fileName)
-
-	return nil
+	return dest
 }
 
 // ================================================================================================
 // Workitem images
-func saveWitStatImage(epicStat []EpicStat, fileName string) error {
-	Info.Println("Generating image ", fileName)
-
+// drawWitStatImage draws the state buckets of each epic as a stacked bar
+func drawWitStatImage(epicStat []EpicStat, weighted bool) *image.RGBA {
 	nEpics := len(epicStat)
 
-	// Find the max count for an Epic
-	maxCount := 0
+	// Find the max count (or points) for an Epic
+	maxCount := 0.0
 	for _, e := range epicStat {
-		count := e.Done + e.InProgress + e.NotDone + e.Unknown
+		done, inProgress, notDone, unknown := e.Buckets(weighted)
+		count := done + inProgress + notDone + unknown
 		if count > maxCount {
 			maxCount = count
 		}
@@ -118,33 +114,75 @@ func saveWitStatImage(epicStat []EpicStat, fileName string) error {
 	draw2d.SetFontFolder(".")
 
 	// Header
-	drawHeader(gc, "Epic Status", w, h)
+	if weighted {
+		drawHeader(gc, "Epic Status (story points)", w, h)
+	} else {
+		drawHeader(gc, "Epic Status", w, h)
+	}
 
 	x, y := 10.0, 50.0
 	// Content
 	for _, es := range epicStat {
-		retY := drawEpicStat(gc, es, maxCount, x, y, w)
+		retY := drawEpicStat(gc, es, weighted, maxCount, x, y, w)
 		y = retY + 20 // gap between two epic
 	}
 
 	// Footer
 	drawFooter(gc, w, h)
 
-	err := draw2dimg.SaveToPngFile(fileName, dest)
-	if err != nil {
-		return err
+	return dest
+}
+
+// drawGroupStatImage draws the state buckets of each tag or area path as a stacked bar
+func drawGroupStatImage(title string, groupStats []GroupStat) *image.RGBA {
+	maxCount := 0.0
+	for _, t := range groupStats {
+		count := float64(t.Done + t.InProgress + t.NotDone + t.Unknown)
+		if count > maxCount {
+			maxCount = count
+		}
 	}
 
-	Info.Println("Generated", fileName)
-	return nil
+	w := 1000.0
+
+	// dedicate pixel for header, then per row and then footer
+	h := 50.0 + 60.0*float64(len(groupStats)) + 20.0
+	dest := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	gc := draw2dimg.NewGraphicContext(dest)
+
+	// Font stuff setup
+	draw2d.SetFontFolder(".")
+
+	drawHeader(gc, title, w, h)
+
+	x, y := 10.0, 50.0
+	for _, t := range groupStats {
+		gc.SetFontSize(12)
+		gc.SetFillColor(color.Black)
+		_, top, _, b := gc.GetStringBounds(t.Name)
+		y += -top
+		gc.FillStringAt(t.Name, x, y)
+		y += b + 5
+
+		barH := 15.0
+		bx := drawBarSegment(gc, float64(t.Done), maxCount, x, y, w-20, barH, WitDoneColor)
+		bx = drawBarSegment(gc, float64(t.InProgress), maxCount, bx, y, w-20, barH, WitInProgressColor)
+		bx = drawBarSegment(gc, float64(t.NotDone), maxCount, bx, y, w-20, barH, WitNotDoneColor)
+		drawBarSegment(gc, float64(t.Unknown), maxCount, bx, y, w-20, barH, WitUnKnownColor)
+		y += barH + 20
+	}
+
+	drawFooter(gc, w, h)
+
+	return dest
 }
 
 // Draw the graph starting at x, y, using width w and return till how many pixel vertically stuff was written
-func drawEpicStat(gc *draw2dimg.GraphicContext, es EpicStat, maxCount int, x, y, w float64) float64 {
+func drawEpicStat(gc *draw2dimg.GraphicContext, es EpicStat, weighted bool, maxCount float64, x, y, w float64) float64 {
 	gc.SetFontSize(12)
 	gc.SetFillColor(color.Black)
 	str := fmt.Sprintf("%v : %s (%s)", es.Epic.Id, es.Epic.Title, es.Epic.AssignedTo)
-	_, t, _, b := gc.GetStringBounds(str)
+	l, t, r, b := gc.GetStringBounds(str)
 
 	// FillString aligns the lower line of text with y, so t actually is negative
 	// So make the adjustment so that the top of text aligns with specified y
@@ -152,46 +190,755 @@ func drawEpicStat(gc *draw2dimg.GraphicContext, es EpicStat, maxCount int, x, y,
 
 	gc.FillStringAt(str, x, y)
 
+	if len(es.Attention) > 0 {
+		drawAttention(gc, len(es.Attention), x+(r-l)+10, y)
+	}
+
+	if es.Forecast != nil {
+		drawForecast(gc, es.Forecast, x+w-20, y)
+	}
+
 	y += b // The text bottom is here now
 
 	y += 5 // Leave some gap between text and the bar
 	barH := 15.0
 
 	w -= 20.0 // actual width to use
-	if es.Done > 0 {
-		barW := (w / float64(maxCount)) * float64(es.Done)
-		drawRect(gc, x, y, barW, barH, color.Black, WitDoneColor)
-		centerInRect(gc, strconv.Itoa(es.Done), x, y, barW, barH)
-		x += barW
+	done, inProgress, notDone, unknown := es.Buckets(weighted)
+	x = drawBarSegment(gc, done, maxCount, x, y, w, barH, WitDoneColor)
+	x = drawBarSegment(gc, inProgress, maxCount, x, y, w, barH, WitInProgressColor)
+	x = drawBarSegment(gc, notDone, maxCount, x, y, w, barH, WitNotDoneColor)
+	drawBarSegment(gc, unknown, maxCount, x, y, w, barH, WitUnKnownColor)
+	y += barH
+
+	return y
+}
+
+// Draw one segment of a stacked bar scaled so that maxCount fills w and return where the next segment starts
+func drawBarSegment(gc *draw2dimg.GraphicContext, value, maxCount, x, y, w, barH float64, fillColor color.Color) float64 {
+	if value <= 0 {
+		return x
+	}
+
+	barW := (w / maxCount) * value
+	drawRect(gc, x, y, barW, barH, color.Black, fillColor)
+	centerInRect(gc, formatValue(value), x, y, barW, barH)
+	return x + barW
+}
+
+// Draw a warning triangle and the number of workitems needing attention starting at x
+func drawAttention(gc *draw2dimg.GraphicContext, count int, x, y float64) {
+	size := 12.0
+	gc.SetFillColor(WitAttentionColor)
+	gc.SetStrokeColor(color.Black)
+	gc.SetLineWidth(1)
+	gc.BeginPath()
+	gc.MoveTo(x+size/2, y-size)
+	gc.LineTo(x+size, y)
+	gc.LineTo(x, y)
+	gc.Close()
+	gc.FillStroke()
+
+	gc.SetFontSize(8)
+	gc.SetFillColor(color.Black)
+	l, _, r, _ := gc.GetStringBounds("!")
+	gc.FillStringAt("!", x+(size-(r-l))/2, y-1)
+
+	gc.SetFontSize(10)
+	gc.SetFillColor(color.RGBA{0xc0, 0, 0, 0xff})
+	gc.FillStringAt(fmt.Sprintf("%v need attention", count), x+size+5, y)
+}
+
+// Draw a diamond marker and the forecast dates with the text right aligned to x
+func drawForecast(gc *draw2dimg.GraphicContext, f *Forecast, x, y float64) {
+	str := "Forecast unavailable"
+	if f.Valid() {
+		str = fmt.Sprintf("Forecast 50%%: %v  85%%: %v  95%%: %v",
+			f.P50.Format("01-02-2006"), f.P85.Format("01-02-2006"), f.P95.Format("01-02-2006"))
+	}
+
+	gc.SetFontSize(10)
+	l, t, r, _ := gc.GetStringBounds(str)
+	textX := x - (r - l)
+	gc.SetFillColor(color.RGBA{50, 50, 50, 0xff})
+	gc.FillStringAt(str, textX, y)
+
+	// diamond vertically centered on the text
+	size := 5.0
+	mx, my := textX-size-5, y+t/2
+	gc.SetFillColor(WitForecastColor)
+	gc.SetStrokeColor(color.Black)
+	gc.SetLineWidth(1)
+	gc.BeginPath()
+	gc.MoveTo(mx, my-size)
+	gc.LineTo(mx+size, my)
+	gc.LineTo(mx, my+size)
+	gc.LineTo(mx-size, my)
+	gc.Close()
+	gc.FillStroke()
+}
+
+// ================================================================================================
+// Workload images
+func drawWorkloadImage(people []AssigneeStat, wipLimit int) *image.RGBA {
+	maxCount := 0.0
+	for _, p := range people {
+		count := float64(p.InProgress + p.NotDone)
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+
+	w := 1000.0
+
+	// dedicate pixel for header, then per row and then footer
+	h := 50.0 + 60.0*float64(len(people)) + 20.0
+	dest := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	gc := draw2dimg.NewGraphicContext(dest)
+
+	// Font stuff setup
+	draw2d.SetFontFolder(".")
+
+	drawHeader(gc, fmt.Sprintf("Workload (WIP limit %v)", wipLimit), w, h)
+
+	x, y := 10.0, 50.0
+	for _, p := range people {
+		gc.SetFontSize(12)
+		str := fmt.Sprintf("%s  In Progress:%v To Do:%v", p.Name, p.InProgress, p.NotDone)
+		if p.InProgress > wipLimit {
+			str += "  Over WIP limit"
+			gc.SetFillColor(color.RGBA{0xc0, 0, 0, 0xff})
+		} else {
+			gc.SetFillColor(color.Black)
+		}
+		_, t, _, b := gc.GetStringBounds(str)
+		y += -t
+		gc.FillStringAt(str, x, y)
+		y += b + 5
+
+		barH := 15.0
+		bx := drawBarSegment(gc, float64(p.InProgress), maxCount, x, y, w-20, barH, WitInProgressColor)
+		drawBarSegment(gc, float64(p.NotDone), maxCount, bx, y, w-20, barH, WitNotDoneColor)
+		y += barH + 20
 	}
 
-	if es.InProgress > 0 {
-		barW := (w / float64(maxCount)) * float64(es.InProgress)
-		drawRect(gc, x, y, barW, barH, color.Black, WitInProgressColor)
-		centerInRect(gc, strconv.Itoa(es.InProgress), x, y, barW, barH)
-		x += barW
+	drawFooter(gc, w, h)
+
+	return dest
+}
+
+// ================================================================================================
+// Dependency images
+func drawDependencyImage(g *DependencyGraph) *image.RGBA {
+	// A column for each epic and one for the workitems outside the epics
+	var columns [][]int
+	var titles []string
+	byEpic := make(map[int][]int)
+	for _, id := range g.linkedNodes() {
+		byEpic[g.Nodes[id].Epic] = append(byEpic[g.Nodes[id].Epic], id)
+	}
+	for _, epic := range g.Epics {
+		if len(byEpic[epic.Id]) > 0 {
+			columns = append(columns, byEpic[epic.Id])
+			titles = append(titles, fmt.Sprintf("%v : %s", epic.Id, epic.Title))
+		}
+	}
+	if len(byEpic[0]) > 0 {
+		columns = append(columns, byEpic[0])
+		titles = append(titles, "Other")
 	}
 
-	if es.NotDone > 0 {
-		barW := (w / float64(maxCount)) * float64(es.NotDone)
-		drawRect(gc, x, y, barW, barH, color.Black, WitNotDoneColor)
-		centerInRect(gc, strconv.Itoa(es.NotDone), x, y, barW, barH)
-		x += barW
+	maxRows := 0
+	for _, c := range columns {
+		if len(c) > maxRows {
+			maxRows = len(c)
+		}
 	}
 
-	if es.Unknown > 0 {
-		barW := (w / float64(maxCount)) * float64(es.Unknown)
-		drawRect(gc, x, y, barW, barH, color.Black, WitUnKnownColor)
-		centerInRect(gc, strconv.Itoa(es.Unknown), x, y, barW, barH)
-		x += barW
+	colW, boxH, rowH := 250.0, 30.0, 45.0
+	w := math.Max(1000.0, 20+colW*float64(len(columns)))
+
+	// dedicate pixel for header, then column titles, per row and then footer
+	h := 50.0 + 20.0 + rowH*float64(maxRows) + 20.0
+	dest := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	gc := draw2dimg.NewGraphicContext(dest)
+
+	// Font stuff setup
+	draw2d.SetFontFolder(".")
+
+	drawHeader(gc, fmt.Sprintf("Dependencies (%v links)", len(g.Edges)), w, h)
+
+	// Lay the boxes out first so that the edges can be drawn below them
+	type box struct{ x, y, w float64 }
+	boxes := make(map[int]box)
+	for i, c := range columns {
+		x := 10 + colW*float64(i)
+		gc.SetFontSize(10)
+		gc.SetFillColor(color.Black)
+		gc.FillStringAt(trimToWidth(gc, titles[i], colW-20), x, 60)
+		for j, id := range c {
+			boxes[id] = box{x, 70 + rowH*float64(j), colW - 40}
+		}
 	}
-	y += barH
 
-	return y
+	for _, e := range g.Edges {
+		from, to := boxes[e.From], boxes[e.To]
+		x1, y1 := from.x+from.w, from.y+boxH/2
+		x2, y2 := to.x, to.y+boxH/2
+		if to.x < from.x {
+			x1, x2 = from.x, to.x+to.w
+		} else if to.x == from.x {
+			// same column, connect the right sides
+			x2 = to.x + to.w
+		}
+
+		lineColor := color.Color(color.RGBA{100, 100, 100, 0xff})
+		if g.Blocking(e) {
+			lineColor = color.RGBA{0xc0, 0, 0, 0xff}
+		}
+		gc.SetStrokeColor(lineColor)
+		gc.SetLineWidth(1.5)
+		if e.Related {
+			gc.SetLineDash([]float64{4, 4}, 0)
+		}
+		gc.BeginPath()
+		gc.MoveTo(x1, y1)
+		gc.LineTo(x2, y2)
+		gc.Stroke()
+		gc.SetLineDash(nil, 0)
+
+		if !e.Related {
+			drawArrowHead(gc, x1, y1, x2, y2, lineColor)
+		}
+	}
+
+	for id, b := range boxes {
+		wi := g.Nodes[id].WorkItem
+		fill := WitNotDoneColor
+		switch stateBucket(wi.State) {
+		case StateDone:
+			fill = WitDoneColor
+		case StateInProgress:
+			fill = WitInProgressColor
+		case StateUnknown:
+			fill = WitUnKnownColor
+		}
+		drawRect(gc, b.x, b.y, b.w, boxH, color.Black, fill)
+
+		gc.SetFontSize(8)
+		gc.SetFillColor(color.Black)
+		gc.FillStringAt(trimToWidth(gc, fmt.Sprintf("%v: %v", wi.Id, wi.Title), b.w-10), b.x+5, b.y+13)
+		gc.FillStringAt(wi.State, b.x+5, b.y+25)
+	}
+
+	drawFooter(gc, w, h)
+
+	return dest
+}
+
+// Draw an arrow head at x2, y2 pointing away from x1, y1
+func drawArrowHead(gc *draw2dimg.GraphicContext, x1, y1, x2, y2 float64, c color.Color) {
+	angle := math.Atan2(y2-y1, x2-x1)
+	size := 8.0
+	gc.SetFillColor(c)
+	gc.SetStrokeColor(c)
+	gc.BeginPath()
+	gc.MoveTo(x2, y2)
+	gc.LineTo(x2-size*math.Cos(angle-math.Pi/6), y2-size*math.Sin(angle-math.Pi/6))
+	gc.LineTo(x2-size*math.Cos(angle+math.Pi/6), y2-size*math.Sin(angle+math.Pi/6))
+	gc.Close()
+	gc.FillStroke()
+}
+
+// ================================================================================================
+// Burnup/burndown images
+func drawBurnChartImage(epic WorkItem, stats []DailyStat) *image.RGBA {
+	w := 1000.0
+	h := 50.0 + 300.0 + 20.0
+	dest := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	gc := draw2dimg.NewGraphicContext(dest)
+
+	// Font stuff setup
+	draw2d.SetFontFolder(".")
+
+	str := fmt.Sprintf("%v : %s (%s)", epic.Id, epic.Title, epic.AssignedTo)
+	drawHeader(gc, str, w, h)
+
+	var dates []time.Time
+	scope := chartSeries{Name: "Scope", Color: color.Black}
+	done := chartSeries{Name: "Done", Color: WitDoneColor}
+	remaining := chartSeries{Name: "Remaining", Color: WitNotDoneColor}
+	for _, s := range stats {
+		dates = append(dates, s.Date)
+		scope.Values = append(scope.Values, float64(s.Total()))
+		done.Values = append(done.Values, float64(s.Done))
+		remaining.Values = append(remaining.Values, float64(s.Total()-s.Done))
+	}
+
+	chartW := (w - 30.0) / 2
+	drawLineChart(gc, "Burnup", 10, 40, chartW, 300, dates, scope, done)
+	drawLineChart(gc, "Burndown", 20+chartW, 40, chartW, 300, dates, remaining)
+
+	drawFooter(gc, w, h)
+
+	return dest
+}
+
+// ================================================================================================
+// Cumulative flow images
+func drawCumulativeFlowImage(title string, stats []DailyStat) *image.RGBA {
+	w := 1000.0
+	h := 50.0 + 400.0 + 20.0
+	dest := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	gc := draw2dimg.NewGraphicContext(dest)
+
+	// Font stuff setup
+	draw2d.SetFontFolder(".")
+
+	drawHeader(gc, title, w, h)
+
+	// Bands are stacked bottom up in this order
+	var dates []time.Time
+	done := chartSeries{Name: "Done", Color: WitDoneColor}
+	inProgress := chartSeries{Name: "In Progress", Color: WitInProgressColor}
+	notDone := chartSeries{Name: "To Do", Color: WitNotDoneColor}
+	unknown := chartSeries{Name: "Unknown", Color: WitUnKnownColor}
+	for _, s := range stats {
+		dates = append(dates, s.Date)
+		done.Values = append(done.Values, float64(s.Done))
+		inProgress.Values = append(inProgress.Values, float64(s.InProgress))
+		notDone.Values = append(notDone.Values, float64(s.NotDone))
+		unknown.Values = append(unknown.Values, float64(s.Unknown))
+	}
+
+	drawStackedAreaChart(gc, "Cumulative Flow", 10, 40, w-20, 400, dates, done, inProgress, notDone, unknown)
+
+	drawFooter(gc, w, h)
+
+	return dest
+}
+
+// ================================================================================================
+// Flow time images
+func drawFlowTimeImage(title string, flowTimes []FlowTime, from, to time.Time) *image.RGBA {
+	w := 1000.0
+	h := 50.0 + 400.0 + 20.0
+	dest := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	gc := draw2dimg.NewGraphicContext(dest)
+
+	// Font stuff setup
+	draw2d.SetFontFolder(".")
+
+	drawHeader(gc, title, w, h)
+
+	lead := scatterSeries{Name: "Lead time (days)", Color: color.RGBA{100, 100, 100, 0xff}}
+	cycle := scatterSeries{Name: "Cycle time (days)", Color: WitDoneColor}
+	for _, f := range flowTimes {
+		lead.Dates = append(lead.Dates, f.Completed)
+		lead.Values = append(lead.Values, f.LeadTime().Hours()/24)
+		if !f.Started.IsZero() {
+			cycle.Dates = append(cycle.Dates, f.Completed)
+			cycle.Values = append(cycle.Values, f.CycleTime().Hours()/24)
+		}
+	}
+
+	drawScatterChart(gc, "Completed workitems", 10, 40, w-20, 400, from, to, lead, cycle)
+
+	drawFooter(gc, w, h)
+
+	return dest
+}
+
+// ================================================================================================
+// Velocity images
+func drawVelocityImage(stats []VelocityStat, usePoints bool) *image.RGBA {
+	w := 1000.0
+	h := 50.0 + 300.0 + 20.0
+	dest := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	gc := draw2dimg.NewGraphicContext(dest)
+
+	// Font stuff setup
+	draw2d.SetFontFolder(".")
+
+	unit := "items"
+	if usePoints {
+		unit = "story points"
+	}
+	drawHeader(gc, fmt.Sprintf("Velocity (%s) of the last %v sprints", unit, len(stats)), w, h)
+
+	done := chartSeries{Name: "Done", Color: WitDoneColor}
+	avg := chartSeries{Name: "Rolling average", Color: WitForecastColor}
+	var names []string
+	for _, s := range stats {
+		names = append(names, s.Sprint.Name)
+		if usePoints {
+			done.Values = append(done.Values, s.Points)
+			avg.Values = append(avg.Values, s.AvgPoints)
+		} else {
+			done.Values = append(done.Values, float64(s.Items))
+			avg.Values = append(avg.Values, s.AvgItems)
+		}
+	}
+
+	drawBarLineChart(gc, 10, 40, w-20, 300, names, done, avg)
+
+	drawFooter(gc, w, h)
+
+	return dest
+}
+
+// ================================================================================================
+// Charts
+type chartSeries struct {
+	Name   string
+	Color  color.Color
+	Values []float64
+}
+
+// Draw a line chart with title, axes and legend within the box at x, y of size w, h
+func drawLineChart(gc *draw2dimg.GraphicContext, title string, x, y, w, h float64, dates []time.Time, series ...chartSeries) {
+	gc.SetFontSize(12)
+	gc.SetFillColor(color.Black)
+	gc.FillStringAt(title, x, y+12)
+
+	// Leave room for title, axis labels and legend
+	plotX, plotY := x+40, y+25
+	plotW, plotH := w-50, h-65
+
+	maxVal := 0.0
+	for _, s := range series {
+		for _, v := range s.Values {
+			if v > maxVal {
+				maxVal = v
+			}
+		}
+	}
+	if maxVal == 0 {
+		maxVal = 1
+	}
+
+	drawAxes(gc, plotX, plotY, plotW, plotH, maxVal, dates)
+
+	for _, s := range series {
+		if len(s.Values) == 0 {
+			continue
+		}
+
+		step := plotW
+		if len(s.Values) > 1 {
+			step = plotW / float64(len(s.Values)-1)
+		}
+
+		gc.SetStrokeColor(s.Color)
+		gc.SetLineWidth(2)
+		gc.BeginPath()
+		for i, v := range s.Values {
+			px := plotX + step*float64(i)
+			py := plotY + plotH - (plotH/maxVal)*v
+			if i == 0 {
+				gc.MoveTo(px, py)
+			} else {
+				gc.LineTo(px, py)
+			}
+		}
+		gc.Stroke()
+	}
+
+	drawLegend(gc, x+40, y+h-10, series)
+}
+
+type scatterSeries struct {
+	Name   string
+	Color  color.Color
+	Dates  []time.Time
+	Values []float64
+}
+
+// Draw a scatter chart of values over the dates from..to within the box at x, y of size w, h
+func drawScatterChart(gc *draw2dimg.GraphicContext, title string, x, y, w, h float64, from, to time.Time, series ...scatterSeries) {
+	gc.SetFontSize(12)
+	gc.SetFillColor(color.Black)
+	gc.FillStringAt(title, x, y+12)
+
+	plotX, plotY := x+40, y+25
+	plotW, plotH := w-50, h-65
+
+	maxVal := 0.0
+	for _, s := range series {
+		for _, v := range s.Values {
+			if v > maxVal {
+				maxVal = v
+			}
+		}
+	}
+	maxVal = math.Ceil(maxVal)
+	if maxVal == 0 {
+		maxVal = 1
+	}
+
+	drawAxes(gc, plotX, plotY, plotW, plotH, maxVal, []time.Time{from, to})
+
+	span := to.Sub(from).Seconds()
+	var legend []chartSeries
+	for _, s := range series {
+		for i, v := range s.Values {
+			px := plotX + plotW*(s.Dates[i].Sub(from).Seconds()/span)
+			py := plotY + plotH - (plotH/maxVal)*v
+			drawRect(gc, px-2, py-2, 4, 4, s.Color, s.Color)
+		}
+		legend = append(legend, chartSeries{Name: s.Name, Color: s.Color})
+	}
+
+	drawLegend(gc, x+40, y+h-10, legend)
+}
+
+// Draw a bar per label for bars and a line over them for line within the box at x, y of size w, h
+func drawBarLineChart(gc *draw2dimg.GraphicContext, x, y, w, h float64, labels []string, bars, line chartSeries) {
+	plotX, plotY := x+40, y+10
+	plotW, plotH := w-50, h-50
+
+	maxVal := 0.0
+	for _, s := range []chartSeries{bars, line} {
+		for _, v := range s.Values {
+			if v > maxVal {
+				maxVal = v
+			}
+		}
+	}
+	maxVal = math.Ceil(maxVal)
+	if maxVal == 0 {
+		maxVal = 1
+	}
+
+	drawAxes(gc, plotX, plotY, plotW, plotH, maxVal, nil)
+	if len(labels) == 0 {
+		return
+	}
+
+	slot := plotW / float64(len(labels))
+	barW := slot * 0.6
+	for i, v := range bars.Values {
+		left := plotX + slot*float64(i) + (slot-barW)/2
+		barH := (plotH / maxVal) * v
+		if barH > 0 {
+			drawRect(gc, left, plotY+plotH-barH, barW, barH, color.Black, bars.Color)
+			centerInRect(gc, formatValue(v), left, plotY+plotH-barH, barW, 15)
+		}
+
+		gc.SetFontSize(8)
+		gc.SetFillColor(color.Black)
+		l, _, r, _ := gc.GetStringBounds(labels[i])
+		gc.FillStringAt(labels[i], left+(barW-(r-l))/2, plotY+plotH+12)
+	}
+
+	// the line goes through the middle of each bar
+	gc.SetStrokeColor(line.Color)
+	gc.SetLineWidth(2)
+	gc.BeginPath()
+	for i, v := range line.Values {
+		px := plotX + slot*float64(i) + slot/2
+		py := plotY + plotH - (plotH/maxVal)*v
+		if i == 0 {
+			gc.MoveTo(px, py)
+		} else {
+			gc.LineTo(px, py)
+		}
+	}
+	gc.Stroke()
+
+	drawLegend(gc, x+40, y+h-10, []chartSeries{bars, line})
+}
+
+// Draw a stacked area chart within the box at x, y of size w, h. The first series is at the bottom.
+func drawStackedAreaChart(gc *draw2dimg.GraphicContext, title string, x, y, w, h float64, dates []time.Time, series ...chartSeries) {
+	gc.SetFontSize(12)
+	gc.SetFillColor(color.Black)
+	gc.FillStringAt(title, x, y+12)
+
+	plotX, plotY := x+40, y+25
+	plotW, plotH := w-50, h-65
+
+	// running total of the series drawn so far, i.e. the lower edge of the next band
+	base := make([]float64, len(dates))
+	maxVal := 0.0
+	for i := range dates {
+		total := 0.0
+		for _, s := range series {
+			total += s.Values[i]
+		}
+		if total > maxVal {
+			maxVal = total
+		}
+	}
+	if maxVal == 0 {
+		maxVal = 1
+	}
+
+	step := plotW
+	if len(dates) > 1 {
+		step = plotW / float64(len(dates)-1)
+	}
+
+	for _, s := range series {
+		if len(dates) == 0 {
+			break
+		}
+
+		// Walk the upper edge left to right and come back along the lower edge
+		gc.SetFillColor(s.Color)
+		gc.SetStrokeColor(s.Color)
+		gc.SetLineWidth(1)
+		gc.BeginPath()
+		for i := range dates {
+			px := plotX + step*float64(i)
+			py := plotY + plotH - (plotH/maxVal)*(base[i]+s.Values[i])
+			if i == 0 {
+				gc.MoveTo(px, py)
+			} else {
+				gc.LineTo(px, py)
+			}
+		}
+		for i := len(dates) - 1; i >= 0; i-- {
+			gc.LineTo(plotX+step*float64(i), plotY+plotH-(plotH/maxVal)*base[i])
+		}
+		gc.Close()
+		gc.FillStroke()
+
+		for i := range dates {
+			base[i] += s.Values[i]
+		}
+	}
+
+	drawAxes(gc, plotX, plotY, plotW, plotH, maxVal, dates)
+	drawLegend(gc, x+40, y+h-10, series)
+}
+
+// Draw the chart axes with the max value on the Y axis and first/last date on the X axis
+func drawAxes(gc *draw2dimg.GraphicContext, x, y, w, h, maxVal float64, dates []time.Time) {
+	gc.SetStrokeColor(color.Black)
+	gc.SetLineWidth(1)
+	gc.BeginPath()
+	gc.MoveTo(x, y)
+	gc.LineTo(x, y+h)
+	gc.LineTo(x+w, y+h)
+	gc.Stroke()
+
+	gc.SetFontSize(8)
+	gc.SetFillColor(color.Black)
+	str := formatValue(maxVal)
+	l, _, r, _ := gc.GetStringBounds(str)
+	gc.FillStringAt(str, x-(r-l)-5, y+5)
+	l, _, r, _ = gc.GetStringBounds("0")
+	gc.FillStringAt("0", x-(r-l)-5, y+h)
+
+	if len(dates) > 0 {
+		gc.FillStringAt(dates[0].Format("01-02"), x, y+h+12)
+		str = dates[len(dates)-1].Format("01-02")
+		l, _, r, _ = gc.GetStringBounds(str)
+		gc.FillStringAt(str, x+w-(r-l), y+h+12)
+	}
+}
+
+// Draw a colored box and the name of each series one after the other starting at x, y
+func drawLegend(gc *draw2dimg.GraphicContext, x, y float64, series []chartSeries) {
+	for _, s := range series {
+		drawRect(gc, x, y-8, 8, 8, color.Black, s.Color)
+		gc.SetFontSize(8)
+		gc.SetFillColor(color.Black)
+		x += 12
+		x += gc.FillStringAt(s.Name, x, y) + 15
+	}
+}
+
+// ================================================================================================
+// Saving
+// imageLock is the mutex of an image file along with how many requests hold or wait for it
+type imageLock struct {
+	sync.Mutex
+	users int
+}
+
+// imageLocks has a lock per image file being saved. Requests for the same report with different
+// params are not coalesced by the cache but still write the same file and blob, so they take turns.
+var imageLocks = struct {
+	sync.Mutex
+	m map[string]*imageLock
+}{m: make(map[string]*imageLock)}
+
+// lockImage locks the image file and returns the func that unlocks it. The lock is dropped once
+// nobody uses it, as the names change with the date.
+func lockImage(fileName string) func() {
+	imageLocks.Lock()
+	l, ok := imageLocks.m[fileName]
+	if !ok {
+		l = &imageLock{}
+		imageLocks.m[fileName] = l
+	}
+	l.users++
+	imageLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		imageLocks.Lock()
+		if l.users--; l.users == 0 {
+			delete(imageLocks.m, fileName)
+		}
+		imageLocks.Unlock()
+	}
+}
+
+// saveAndUpload saves the image under the name in the store and uploads it unless -nu is given
+func (s *ImageStore) saveAndUpload(img image.Image, name string) error {
+	fileName := s.Path(name)
+	defer lockImage(fileName)()
+
+	Info.Println("Generating image ", fileName)
+	if err := draw2dimg.SaveToPngFile(fileName, img); err != nil {
+		return err
+	}
+	Info.Println("Generated", fileName)
+
+	if noUpload {
+		return nil
+	}
+
+	url, err := uploadImageToAzure(s.Account, s.Key, fileName)
+	if err != nil {
+		return err
+	}
+	Info.Println("Uploaded to", url)
+
+	return nil
 }
 
 // ================================================================================================
 // Common utilty
+// trimToWidth shortens s with ... so that it fits in w at the current font size
+func trimToWidth(gc *draw2dimg.GraphicContext, s string, w float64) string {
+	l, _, r, _ := gc.GetStringBounds(s)
+	if r-l <= w {
+		return s
+	}
+
+	runes := []rune(s)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		str := string(runes) + "..."
+		l, _, r, _ = gc.GetStringBounds(str)
+		if r-l <= w {
+			return str
+		}
+	}
+
+	return ""
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
 func centerInRect(gc *draw2dimg.GraphicContext, s string, x, y, barW, barH float64) {
 	gc.SetFontSize(8)
 
@@ -0,0 +1,240 @@
+package main
+
+// Docs
+// https://docs.microsoft.com/en-us/rest/api/azure/devops/work/iterations/list?view=azure-devops-rest-4.1
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	az "github.com/benmatselby/go-azuredevops/azuredevops"
+)
+
+type AzureDevopsIteration struct {
+	client *az.Client
+	team   string
+}
+
+type IterationsResponse struct {
+	Count      int         `json:"count"`
+	Iterations []Iteration `json:"value"`
+}
+
+type Iteration struct {
+	Id         string              `json:"id"`
+	Name       string              `json:"name"`
+	Path       string              `json:"path"`
+	Attributes IterationAttributes `json:"attributes"`
+}
+
+type IterationAttributes struct {
+	StartDate  time.Time `json:"startDate"`
+	FinishDate time.Time `json:"finishDate"`
+	TimeFrame  string    `json:"timeFrame"`
+}
+
+type SprintStat struct {
+	Sprint   Iteration
+	Previous Iteration // zero if there is no previous sprint
+
+	Items     []WorkItem // workitems currently in the sprint
+	CarryOver []WorkItem // workitems not done in the previous sprint and moved to this one
+
+	Committed int // workitems in the sprint when it started
+	Completed int // committed workitems that are done
+	Done      int // all done workitems, including the ones added after the sprint started
+}
+
+// VelocityStat is what got done in a sprint along with the rolling average of the sprints up to it
+type VelocityStat struct {
+	Sprint    Iteration
+	Items     int
+	Points    float64
+	AvgItems  float64
+	AvgPoints float64
+}
+
+func NewIteration(account, project, token, team string) (r *AzureDevopsIteration) {
+	r = &AzureDevopsIteration{}
+	r.client = constructClientFromConfig(account, project, token)
+	r.team = team
+
+	return
+}
+
+// GetIterations returns the iterations of the team ordered by start date
+func (r *AzureDevopsIteration) GetIterations() ([]Iteration, error) {
+	// https://docs.microsoft.com/en-us/rest/api/azure/devops/work/iterations/list?view=azure-devops-rest-4.1
+	URL := fmt.Sprintf("%s/_apis/work/teamsettings/iterations?api-version=4.1", url.PathEscape(r.team))
+
+	request, err := r.client.NewRequest("GET", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var response IterationsResponse
+	_, err = r.client.Execute(request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	iterations := response.Iterations
+	sort.SliceStable(iterations, func(i, j int) bool {
+		return iterations[i].Attributes.StartDate.Before(iterations[j].Attributes.StartDate)
+	})
+
+	return iterations, nil
+}
+
+// GetCurrentIteration returns the current iteration and the one before it
+func (r *AzureDevopsIteration) GetCurrentIteration() (Iteration, Iteration, error) {
+	iterations, err := r.GetIterations()
+	if err != nil {
+		return Iteration{}, Iteration{}, err
+	}
+
+	now := time.Now()
+	for i, it := range iterations {
+		if it.Attributes.TimeFrame == "current" ||
+			(!now.Before(it.Attributes.StartDate) && now.Before(it.Attributes.FinishDate.AddDate(0, 0, 1))) {
+			if i == 0 {
+				return it, Iteration{}, nil
+			}
+			return it, iterations[i-1], nil
+		}
+	}
+
+	return Iteration{}, Iteration{}, fmt.Errorf("No current iteration for team %v", r.team)
+}
+
+// GetPastIterations returns the last count iterations that have finished, oldest first
+func (r *AzureDevopsIteration) GetPastIterations(count int) ([]Iteration, error) {
+	iterations, err := r.GetIterations()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var past []Iteration
+	for _, it := range iterations {
+		if it.Attributes.TimeFrame == "past" ||
+			(!it.Attributes.FinishDate.IsZero() && it.Attributes.FinishDate.AddDate(0, 0, 1).Before(now)) {
+			past = append(past, it)
+		}
+	}
+
+	if len(past) > count {
+		past = past[len(past)-count:]
+	}
+
+	return past, nil
+}
+
+// GetIterationWorkitemIds returns the ids of the workitems (other than epics and features) in the iteration
+func (r *AzureDevopsIteration) GetIterationWorkitemIds(it Iteration) ([]int, error) {
+	URL := "_apis/wit/wiql?api-version=4.1"
+
+	body := `
+	SELECT
+	[System.Id]
+	FROM workitems
+	WHERE
+		[System.TeamProject] = @project
+		AND [System.IterationPath] = '%s'
+		AND [System.WorkItemType] NOT IN ('Epic', 'Feature')
+	`
+	var wiqlQuery WiqlQuery
+	wiqlQuery.Query = fmt.Sprintf(body, strings.Replace(it.Path, "'", "''", -1))
+	request, err := r.client.NewRequest("POST", URL, wiqlQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var response WitQueryResult
+	_, err = r.client.Execute(request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, w := range response.WorkItems {
+		ids = append(ids, w.Id)
+	}
+
+	return ids, nil
+}
+
+// getSprintStat replays the histories of the workitems in the sprint to find what was committed
+// at the start and what was carried over from the previous sprint. Workitems that got moved
+// out of the sprint are not in histories and so are not counted as committed.
+func getSprintStat(sprint, previous Iteration, histories []WorkItemHistory) SprintStat {
+	stat := SprintStat{Sprint: sprint, Previous: previous}
+
+	// Sprint dates are days, so look at the end of the first day and end of the last day
+	start := sprint.Attributes.StartDate.AddDate(0, 0, 1)
+	prevEnd := previous.Attributes.FinishDate.AddDate(0, 0, 1)
+
+	for _, h := range histories {
+		wi := h.Latest()
+		stat.Items = append(stat.Items, wi)
+
+		done := stateBucket(wi.State) == StateDone
+		if done {
+			stat.Done++
+		}
+
+		if old, ok := h.At(start); ok && old.IterationPath == sprint.Path {
+			stat.Committed++
+			if done {
+				stat.Completed++
+			}
+		}
+
+		if len(previous.Path) == 0 {
+			continue
+		}
+
+		if old, ok := h.At(prevEnd); ok && old.IterationPath == previous.Path && stateBucket(old.State) != StateDone {
+			stat.CarryOver = append(stat.CarryOver, wi)
+		}
+	}
+
+	return stat
+}
+
+// getVelocityStat counts the done workitems and their story points in the sprint
+func getVelocityStat(sprint Iteration, items []WorkItem) VelocityStat {
+	stat := VelocityStat{Sprint: sprint}
+	for _, wi := range items {
+		if stateBucket(wi.State) != StateDone || wi.State == "Removed" {
+			continue
+		}
+
+		stat.Items++
+		stat.Points += wi.Points()
+	}
+
+	return stat
+}
+
+// setRollingAverage sets the average of each sprint and the window-1 sprints before it
+func setRollingAverage(stats []VelocityStat, window int) {
+	for i := range stats {
+		start := i - window + 1
+		if start < 0 {
+			start = 0
+		}
+
+		items, points := 0.0, 0.0
+		for _, s := range stats[start : i+1] {
+			items += float64(s.Items)
+			points += s.Points
+		}
+
+		n := float64(i + 1 - start)
+		stats[i].AvgItems = items / n
+		stats[i].AvgPoints = points / n
+	}
+}
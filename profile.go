@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Profile is an Azure DevOps project along with its repo, team and epic query. The default profile
+// is served at / and the others at /{name}/.
+type Profile struct {
+	Name      string // empty for the default profile
+	Account   string
+	Project   string
+	Token     string
+	Repo      string
+	Team      string
+	EpicQuery string
+	Images    *ImageStore
+}
+
+// ImageStore is where the images generated for a profile are saved and uploaded
+type ImageStore struct {
+	Dir     string // under the working directory, empty for the default profile
+	Account string
+	Key     string
+}
+
+// Path is where an image is saved and the name of the blob it is uploaded to
+func (s *ImageStore) Path(name string) string {
+	return filepath.Join(s.Dir, name)
+}
+
+var defaultProfile *Profile
+var profiles []*Profile // in the order of their names
+
+var profileName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Profile names can not hide the endpoints of the default profile, which is named default in the
+// roles of the config
+var reservedProfileNames = map[string]bool{defaultProfileName: true, "wit": true, "pr": true, "sprint": true, "images": true}
+
+const defaultProfileName = "default"
+
+func NewProfile(name string, devops DevOpsConfig, epicQuery string) *Profile {
+	return &Profile{
+		Name:      name,
+		Account:   devops.Account,
+		Project:   devops.Project,
+		Token:     devops.Token,
+		Repo:      devops.Repo,
+		Team:      devops.Team,
+		EpicQuery: epicQuery,
+		Images:    &ImageStore{Dir: name, Account: azStorageAcc, Key: azStorageKey},
+	}
+}
+
+// Root is the path the endpoints of the profile are under, empty for the default profile
+func (p *Profile) Root() string {
+	if len(p.Name) == 0 {
+		return ""
+	}
+	return "/" + p.Name
+}
+
+// allProfiles returns the default profile followed by the named ones
+func allProfiles() []*Profile {
+	return append([]*Profile{defaultProfile}, profiles...)
+}
+
+// createImageDirs creates the directories the images of the named profiles are saved in
+func createImageDirs() error {
+	for _, p := range profiles {
+		if err := os.MkdirAll(p.Images.Dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type profileKey struct{}
+
+// withProfile serves the request for the profile
+func withProfile(p *Profile, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), profileKey{}, p)))
+	}
+}
+
+// requestProfile returns the profile the request is for
+func requestProfile(r *http.Request) *Profile {
+	if p, ok := r.Context().Value(profileKey{}).(*Profile); ok {
+		return p
+	}
+	return defaultProfile
+}
+
+// profileByName returns the named profile, the default one for an empty name and nil if there is none
+func profileByName(name string) *Profile {
+	for _, p := range allProfiles() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
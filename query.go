@@ -0,0 +1,150 @@
+package main
+
+// Docs
+// https://docs.microsoft.com/en-us/rest/api/azure/devops/wit/wiql/query%20by%20wiql?view=azure-devops-rest-4.1
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxQueryItems  = 1000
+	maxQueryLength = 32 * 1024 // WIQL queries are limited to 32K characters
+)
+
+// Named WIQL queries that can be run using /wit/query?template=<name>. @doneStates is replaced
+// with the states of the done bucket.
+var wiqlTemplates = map[string]string{
+	"active": `SELECT [System.Id] FROM workitems
+		WHERE [System.TeamProject] = @project
+		AND [System.State] IN ('Committed', 'In Progress')`,
+	"unassigned": `SELECT [System.Id] FROM workitems
+		WHERE [System.TeamProject] = @project
+		AND [System.AssignedTo] = ''
+		AND [System.State] NOT IN @doneStates`,
+	"recent": `SELECT [System.Id] FROM workitems
+		WHERE [System.TeamProject] = @project
+		AND [System.ChangedDate] >= @Today - 7`,
+	"bugs": `SELECT [System.Id] FROM workitems
+		WHERE [System.TeamProject] = @project
+		AND [System.WorkItemType] = 'Bug'
+		AND [System.State] NOT IN @doneStates`,
+}
+
+var (
+	wiqlStringLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+	wiqlFieldRef      = regexp.MustCompile(`\[[^\]]*\]`)
+	wiqlNotReadOnly   = regexp.MustCompile(`(?i)\b(INSERT|UPDATE|DELETE|DROP|CREATE|ALTER|EXEC|MERGE|TRUNCATE)\b`)
+	wiqlSelect        = regexp.MustCompile(`(?is)^SELECT\s.+\sFROM\s+(workitems|workitemlinks)\b`)
+)
+
+// validateWiql makes sure the query is a single read-only SELECT statement
+func validateWiql(query string) error {
+	query = strings.TrimSpace(query)
+	if len(query) == 0 {
+		return fmt.Errorf("Empty query")
+	}
+
+	// keywords inside string literals are just values
+	stripped := wiqlStringLiteral.ReplaceAllString(query, "@literal")
+	if strings.Contains(stripped, "'") {
+		return fmt.Errorf("Unterminated string in query")
+	}
+
+	// and so are field references like [Custom.Merge]
+	stripped = wiqlFieldRef.ReplaceAllString(stripped, "[field]")
+
+	if strings.Contains(stripped, ";") {
+		return fmt.Errorf("Only a single statement is allowed")
+	}
+
+	if !wiqlSelect.MatchString(stripped) {
+		return fmt.Errorf("Only SELECT ... FROM workitems or workitemLinks queries are allowed")
+	}
+
+	if m := wiqlNotReadOnly.FindString(stripped); len(m) != 0 {
+		return fmt.Errorf("%v is not allowed in a read-only query", strings.ToUpper(m))
+	}
+
+	return nil
+}
+
+// wiqlTemplate returns the named query with the done states of the config
+func wiqlTemplate(name string) (string, bool) {
+	query, ok := wiqlTemplates[name]
+	return strings.Replace(query, "@doneStates", bucketStates(StateDone), -1), ok
+}
+
+func templateNames() []string {
+	var names []string
+	for name := range wiqlTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// RunQuery runs the WIQL query and returns the workitems in it. At most maxQueryItems are returned.
+func (r *AzureDevopsWit) RunQuery(query string) ([]WorkItem, error) {
+	URL := fmt.Sprintf("_apis/wit/wiql?$top=%v&api-version=4.1", maxQueryItems)
+
+	var wiqlQuery WiqlQuery
+	wiqlQuery.Query = query
+	request, err := r.client.NewRequest("POST", URL, wiqlQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var response WitQueryResult
+	_, err = r.client.Execute(request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	var workItems []WorkItem
+	seen := make(map[int]bool)
+	for _, id := range response.Ids() {
+		// link queries return the same workitem once for each link
+		if seen[id] || id == 0 {
+			continue
+		}
+		seen[id] = true
+
+		wi, err := r.GetWorkitem(id)
+		if err != nil {
+			return nil, err
+		}
+		workItems = append(workItems, wi)
+	}
+
+	return workItems, nil
+}
+
+// ================================================================================================
+// Output
+var workItemColumns = []string{"Id", "Type", "State", "Title", "AssignedTo", "ChangedDate"}
+
+func workItemRow(wi WorkItem) []string {
+	return []string{strconv.Itoa(wi.Id), wi.Type, wi.State, wi.Title, wi.AssignedTo, wi.ChangedDate.Format(time.RFC3339)}
+}
+
+func writeWorkItemsTable(buffer *bytes.Buffer, items []WorkItem) {
+	buffer.WriteString(fmt.Sprintf("%8s %-20s %-12s %-30s %s\n", "Id", "Type", "State", "AssignedTo", "Title"))
+	for _, wi := range items {
+		buffer.WriteString(fmt.Sprintf("%8d %-20s %-12s %-30s %s\n", wi.Id, wi.Type, wi.State, wi.AssignedTo, wi.Title))
+	}
+}
+
+func workItemTable(items []WorkItem) reportTable {
+	table := reportTable{Columns: workItemColumns}
+	for _, wi := range items {
+		table.Rows = append(table.Rows, workItemRow(wi))
+	}
+	return table
+}
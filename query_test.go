@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateWiql(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string // part of the error, empty if the query is allowed
+	}{
+		{"SELECT [System.Id] FROM workitems WHERE [System.TeamProject] = @project", ""},
+		{"  select [System.Id]\nfrom WorkItemLinks\nwhere [Source].[System.Id] = 1  ", ""},
+
+		// field references named like keywords
+		{"SELECT [System.Id], [Custom.Merge] FROM workitems", ""},
+		{"SELECT [System.Id] FROM workitems WHERE [Custom.Delete] = 'x' ORDER BY [Custom.Update]", ""},
+		{"SELECT [System.Id] FROM workitems WHERE [Custom.A;B] = 1", ""},
+
+		// keywords inside literals
+		{"SELECT [System.Id] FROM workitems WHERE [System.Title] = 'DROP the ; UPDATE'", ""},
+		{"SELECT [System.Id] FROM workitems WHERE [System.Title] = 'it''s; DELETE'", ""},
+
+		{"", "Empty query"},
+		{"   ", "Empty query"},
+		{"SELECT [System.Id] FROM workitems WHERE [System.Title] = 'open", "Unterminated string"},
+		{"SELECT [System.Id] FROM workitems WHERE [System.Title] = 'it''s", "Unterminated string"},
+		{"SELECT [System.Id] FROM workitems; DELETE FROM workitems", "single statement"},
+		{"SELECT [System.Id] FROM workitems;", "single statement"},
+		{"UPDATE workitems SET [System.State] = 'Done'", "Only SELECT"},
+		{"DELETE FROM workitems", "Only SELECT"},
+		{"SELECT [System.Id] FROM users", "Only SELECT"},
+		{"SELECT [System.Id] FROM workitems WHERE [System.Id] IN (EXEC x)", "EXEC is not allowed"},
+		{"SELECT [System.Id] FROM workitems WHERE merge = 1", "MERGE is not allowed"},
+	}
+
+	for _, test := range tests {
+		err := validateWiql(test.query)
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("validateWiql(%q): %v", test.query, err)
+		case len(test.err) != 0 && err == nil:
+			t.Errorf("validateWiql(%q) succeeded, want an error with %q", test.query, test.err)
+		case len(test.err) != 0 && !strings.Contains(err.Error(), test.err):
+			t.Errorf("validateWiql(%q) = %q, want an error with %q", test.query, err, test.err)
+		}
+	}
+}
@@ -44,8 +44,19 @@ type PullRequest struct {
 }
 
 type ReviewerStat struct {
-	Name  string
-	Count int
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// PrReport is the review count of each reviewer over the last completed pull requests
+type PrReport struct {
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Count       int            `json:"count"`     // pull requests asked for
+	Processed   int            `json:"processed"` // pull requests actually completed, can be less than count
+	From        time.Time      `json:"from"`      // closed date of the oldest and the newest pull request
+	To          time.Time      `json:"to"`
+	MaxReviews  int            `json:"maxReviews"`
+	Reviewers   []ReviewerStat `json:"reviewers"`
 }
 
 // Repository represents a repository used by a build definition
@@ -115,14 +126,16 @@ func (r *AzureDevopsRepo) GetPullRequestReviewsByUser(count int) ([]ReviewerStat
 	r.Refresh(count)
 	prs := r.PullRequests
 
-	Info.Println("PRs from", prs[len(prs)-1].ClosedDate)
+	if len(prs) > 0 {
+		Info.Println("PRs from", prs[len(prs)-1].ClosedDate)
+	}
 
 	// Iterate and create a map of reviewers[review-count]
 	review := make(map[string]int)
 	for _, pr := range prs {
 		for _, rv := range pr.Reviewers {
 			// filter for specific user and ensure we do not count PR creater approving their own PR
-			if !strings.Contains(rv.DisplayName, "AzLinux SAP HANA RP Devs") && rv.Vote != 0 && rv.DisplayName != pr.CreatedBy.DisplayName {
+			if !isExcludedReviewer(rv.DisplayName) && rv.Vote != 0 && rv.DisplayName != pr.CreatedBy.DisplayName {
 				review[rv.DisplayName]++
 			}
 		}
@@ -145,6 +158,36 @@ func (r *AzureDevopsRepo) GetPullRequestReviewsByUser(count int) ([]ReviewerStat
 	return reviewerStat, max
 }
 
+// GetPullRequestReport returns the reviewer stats of the last count completed pull requests
+// along with the time window they were closed in
+func (r *AzureDevopsRepo) GetPullRequestReport(count int) (PrReport, error) {
+	report := PrReport{GeneratedAt: time.Now(), Count: count}
+	if r.err != nil {
+		return report, r.err
+	}
+
+	report.Reviewers, report.MaxReviews = r.GetPullRequestReviewsByUser(count)
+	if r.err != nil {
+		return report, r.err
+	}
+
+	report.Processed = len(r.PullRequests)
+	for _, pr := range r.PullRequests {
+		if report.From.IsZero() || pr.ClosedDate.Before(report.From) {
+			report.From = pr.ClosedDate
+		}
+		if pr.ClosedDate.After(report.To) {
+			report.To = pr.ClosedDate
+		}
+	}
+
+	if report.Reviewers == nil {
+		report.Reviewers = []ReviewerStat{}
+	}
+
+	return report, nil
+}
+
 func (r *AzureDevopsRepo) loadPullRequests(count int) error {
 	params := url.Values{}
 	params.Add("searchCriteria.repositoryId", r.Repo.ID)
@@ -176,6 +219,16 @@ func constructClientFromConfig(account, project, token string) *az.Client {
 	return az.NewClient(account, project, token)
 }
 
+// isExcludedReviewer is true for the reviewers, like groups, excluded in the config
+func isExcludedReviewer(name string) bool {
+	for _, excluded := range excludedReviewers {
+		if strings.Contains(name, excluded) {
+			return true
+		}
+	}
+	return false
+}
+
 func containsUser(name string, Users ...User) bool {
 	for _, user := range Users {
 		if user.DisplayName == name || user.UniqueName == name {
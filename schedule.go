@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a cron expression with the five fields minute, hour, day of month, month and
+// day of week. Each field is a *, a value, a range like 1-5, a step like */15 or 0-30/10, or a
+// comma separated list of those. Bit i of a field is set when i matches.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// As in cron, when both day of month and day of week are restricted either one can match. A
+	// field starting with *, like */2, does not count as restricted.
+	domAny, dowAny bool
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCron(expr string) (*CronSchedule, error) {
+	if s, ok := cronShortcuts[expr]; ok {
+		expr = s
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Cron expression %q needs 5 fields, minute hour day month weekday", expr)
+	}
+
+	limits := []struct {
+		name     string
+		min, max int
+	}{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 7},
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, limits[i].min, limits[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v in %q: %v", limits[i].name, expr, err)
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &CronSchedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch i := strings.Index(part, "-"); {
+		case part == "*":
+		case i >= 0:
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(part[:i])
+			hi, err2 = strconv.Atoi(part[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			var err error
+			lo, err = strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			// A value with a step, like 5/15, starts there and goes on till the max
+			if step == 1 {
+				hi = lo
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %v-%v", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t that matches the schedule, zero if there is none in the
+// next few years (e.g. the 31st of February)
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		loc := t.Location()
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// ScheduledReport is a report endpoint, with its params, that is run on a cron schedule
+type ScheduledReport struct {
+	Schedule *CronSchedule
+	Path     string // e.g. /wit?weight=points
+}
+
+// parseScheduledReport parses the cron expression followed by the report, like "0 7 * * 1-5 /pr?count=400"
+func parseScheduledReport(spec string, reports map[string]http.HandlerFunc) (ScheduledReport, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return ScheduledReport{}, fmt.Errorf("Schedule %q needs a cron expression and a report", spec)
+	}
+
+	path := fields[len(fields)-1]
+	u, err := url.Parse(path)
+	if err != nil {
+		return ScheduledReport{}, fmt.Errorf("Invalid report %q: %v", path, err)
+	}
+
+	if _, ok := reports[u.Path]; !ok {
+		return ScheduledReport{}, fmt.Errorf("Unknown report %q in schedule %q", u.Path, spec)
+	}
+
+	schedule, err := parseCron(strings.Join(fields[:len(fields)-1], " "))
+	if err != nil {
+		return ScheduledReport{}, err
+	}
+
+	return ScheduledReport{schedule, path}, nil
+}
+
+// runScheduledReport runs the report each time it is due and caches the result till the next run,
+// so that the endpoint serves it. The report handlers upload the images they generate.
+func runScheduledReport(job ScheduledReport, reports map[string]http.HandlerFunc, cache *ResultCache) {
+	for {
+		next := job.Schedule.Next(time.Now())
+		if next.IsZero() {
+			Warning.Println("Schedule never runs", job.Path)
+			return
+		}
+
+		Info.Printf("Next scheduled run of %v at %v\n", job.Path, next)
+		time.Sleep(time.Until(next))
+
+		r, err := http.NewRequest("GET", job.Path, nil)
+		if err != nil {
+			Error.Println("Error creating scheduled request", job.Path, err)
+			continue
+		}
+		r.RequestURI = job.Path
+
+		Info.Println("Running scheduled report", job.Path)
+		status := cache.Warm(reports[r.URL.Path], r, job.Schedule.Next(time.Now()))
+		if status != http.StatusOK {
+			Error.Printf("Scheduled report %v failed with %v\n", job.Path, status)
+		}
+	}
+}
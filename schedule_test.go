@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// Tuesday
+	now := time.Date(2019, 5, 14, 10, 2, 30, 0, time.UTC)
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2019, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		// steps and lists
+		{"*/15 * * * *", now, at(5, 14, 10, 15)},
+		{"5/20 * * * *", now, at(5, 14, 10, 5)},
+		{"5/20 * * * *", at(5, 14, 10, 6), at(5, 14, 10, 25)},
+		{"0-30/10 12 * * *", now, at(5, 14, 12, 0)},
+		{"0-30/10 12 * * *", at(5, 14, 12, 5), at(5, 14, 12, 10)},
+		{"30 9,17 * * *", now, at(5, 14, 17, 30)},
+		{"2 10 * * *", now, at(5, 15, 10, 2)},
+
+		// ranges of weekdays
+		{"0 7 * * 1-5", now, at(5, 15, 7, 0)},
+		{"0 7 * * 1-5", at(5, 17, 10, 0), at(5, 20, 7, 0)},
+		{"0 0 * * 7", now, at(5, 19, 0, 0)},
+
+		// shortcuts
+		{"@hourly", now, at(5, 14, 11, 0)},
+		{"@daily", now, at(5, 15, 0, 0)},
+		{"@weekly", now, at(5, 19, 0, 0)},
+		{"@monthly", now, at(6, 1, 0, 0)},
+
+		// day of month or day of week when both are restricted
+		{"0 0 1 * 5", now, at(5, 17, 0, 0)},
+		{"0 0 1 * 5", at(5, 31, 0, 0), at(6, 1, 0, 0)},
+		{"0 0 13 * *", now, at(6, 13, 0, 0)},
+
+		// and both when either starts with *
+		{"0 0 */2 * 1", now, at(5, 27, 0, 0)},
+		{"0 0 1 * */2", now, at(6, 1, 0, 0)},
+
+		// months and years
+		{"0 0 1 1 *", now, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", now, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", now, time.Time{}},
+	}
+
+	for _, test := range tests {
+		s, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+
+		if got := s.Next(test.from); !got.Equal(test.want) {
+			t.Errorf("%q.Next(%v) = %v, want %v", test.expr, test.from, got, test.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@yearly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
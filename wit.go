@@ -4,6 +4,8 @@ package main
 // https://docs.microsoft.com/en-us/rest/api/azure/devops/wit/?view=azure-devops-rest-4.1
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	az "github.com/benmatselby/go-azuredevops/azuredevops"
@@ -26,7 +28,9 @@ type WitQueryResult struct {
 }
 
 type WorkItemRelations struct {
-	Target WitTarget `json:"target"`
+	Rel    string     `json:"rel"`
+	Source *WitTarget `json:"source"` // nil for the roots of a tree query
+	Target WitTarget  `json:"target"`
 }
 
 type WitTarget struct {
@@ -34,12 +38,19 @@ type WitTarget struct {
 }
 
 type WorkItem struct {
-	Id          int `json:"id"`
-	State       string
-	Type        string
-	Title       string
-	AssignedTo  string
-	ChangedDate time.Time
+	Id            int       `json:"id"`
+	State         string    `json:"state"`
+	Type          string    `json:"type"`
+	Title         string    `json:"title"`
+	AssignedTo    string    `json:"assignedTo"`
+	ChangedDate   time.Time `json:"changedDate"`
+	AreaPath      string    `json:"areaPath"`
+	IterationPath string    `json:"iterationPath"`
+	Tags          []string  `json:"tags"`
+	Blocked       bool      `json:"blocked"`
+	StoryPoints   float64   `json:"storyPoints"`
+	Effort        float64   `json:"effort"`
+	RemainingWork float64   `json:"remainingWork"`
 }
 
 type WorkItemInternal struct {
@@ -53,20 +64,81 @@ type Fields struct {
 	Title       string `json:"System.Title"`
 	AssignedTo  string `json:"System.AssignedTo"`
 	ChangedDate string `json:"System.ChangedDate"`
-}
 
-type WiqlQuery struct {
-	Query string `json:"query"`
+	AreaPath      string `json:"System.AreaPath"`
+	IterationPath string `json:"System.IterationPath"`
+	Tags          string `json:"System.Tags"`                 // semicolon separated
+	Blocked       string `json:"Microsoft.VSTS.CMMI.Blocked"` // Yes or No
+
+	StoryPoints   float64 `json:"Microsoft.VSTS.Scheduling.StoryPoints"`
+	Effort        float64 `json:"Microsoft.VSTS.Scheduling.Effort"`
+	RemainingWork float64 `json:"Microsoft.VSTS.Scheduling.RemainingWork"`
 }
 
-type EpicStat struct {
-	Epic       WorkItem
+// AssigneeStat is the count of workitems in each state bucket assigned to a person
+type AssigneeStat struct {
+	Name       string
 	Done       int
 	NotDone    int
 	InProgress int
 	Unknown    int
 }
 
+// GroupStat is the count of workitems in each state bucket that belong to a group, like
+// a tag or an area path
+type GroupStat struct {
+	Name       string `json:"name"`
+	Done       int    `json:"done"`
+	NotDone    int    `json:"notDone"`
+	InProgress int    `json:"inProgress"`
+	Unknown    int    `json:"unknown"`
+}
+
+// AttentionItem is a workitem that is not done and looks stuck
+type AttentionItem struct {
+	WorkItem WorkItem `json:"workItem"`
+	Reasons  []string `json:"reasons"`
+}
+
+type WiqlQuery struct {
+	Query string `json:"query"`
+}
+
+// Buckets workitem states are grouped into
+const (
+	StateNotDone = iota
+	StateInProgress
+	StateDone
+	StateUnknown
+)
+
+type EpicStat struct {
+	Epic       WorkItem `json:"epic"`
+	Done       int      `json:"done"`
+	NotDone    int      `json:"notDone"`
+	InProgress int      `json:"inProgress"`
+	Unknown    int      `json:"unknown"`
+
+	// Same buckets weighted by the story points (or effort) of the workitems
+	DonePoints       float64 `json:"donePoints"`
+	NotDonePoints    float64 `json:"notDonePoints"`
+	InProgressPoints float64 `json:"inProgressPoints"`
+	UnknownPoints    float64 `json:"unknownPoints"`
+
+	// Sum of the remaining work of the workitems not yet done
+	RemainingWork float64 `json:"remainingWork"`
+
+	// Only set when a forecast was asked for
+	Forecast *Forecast `json:"forecast,omitempty"`
+
+	// Buckets for each tag on the workitems and each area path they are in, ordered by name
+	Tags  []GroupStat `json:"tags"`
+	Areas []GroupStat `json:"areas"`
+
+	// Workitems that are blocked, stale or unassigned
+	Attention []AttentionItem `json:"attention"`
+}
+
 func NewWork(account, project, token string) (r *AzureDevopsWit) {
 	r = &AzureDevopsWit{}
 	r.client = constructClientFromConfig(account, project, token)
@@ -75,6 +147,27 @@ func NewWork(account, project, token string) (r *AzureDevopsWit) {
 }
 
 func (r *AzureDevopsWit) GetWorkitems(queryId string) ([]WorkItem, error) {
+	ids, err := r.loadQueryIds(queryId)
+	if err != nil {
+		return nil, err
+	}
+
+	var workItems []WorkItem
+
+	for _, id := range ids {
+		wi, err := r.GetWorkitem(id)
+		if err != nil {
+			return nil, err
+		}
+		workItems = append(workItems, wi)
+	}
+
+	return workItems, nil
+}
+
+// loadQueryIds runs a saved query and returns the ids of the workitems in it. For tree
+// queries the ids of the link targets are returned.
+func (r *AzureDevopsWit) loadQueryIds(queryId string) ([]int, error) {
 	// https://docs.microsoft.com/en-us/rest/api/azure/devops/wit/wiql/query%20by%20id?view=azure-devops-rest-4.1
 	URL := fmt.Sprintf("_apis/wit/wiql/%s?api-version=4.1", queryId)
 
@@ -90,20 +183,37 @@ func (r *AzureDevopsWit) GetWorkitems(queryId string) ([]WorkItem, error) {
 		return nil, err
 	}
 
-	var workItems []WorkItem
+	return response.Ids(), nil
+}
 
-	for _, w := range response.WorkItems {
-		wi, err := r.GetWorkitem(w.Id)
-		if err != nil {
-			return nil, err
-		}
-		workItems = append(workItems, wi)
+// Ids returns the ids of the workitems in a flat query result or the link targets in a tree query result
+func (res WitQueryResult) Ids() []int {
+	var ids []int
+	for _, w := range res.WorkItems {
+		ids = append(ids, w.Id)
 	}
 
-	return workItems, nil
+	for _, w := range res.WitRelations {
+		ids = append(ids, w.Target.Id)
+	}
+
+	return ids
 }
 
-func (q *AzureDevopsWit) RefreshWit(parentEpic int, filterSemester bool) (EpicStat, error) {
+// semesterStart is the start of the semester now is in, January or July
+func semesterStart(now time.Time) time.Time {
+	month := time.January // First semester
+	if now.Month() >= 7 {
+		month = time.July // Second semester
+	}
+
+	return time.Date(now.Year(), month, 1, 0, 0, 0, 0, time.Local)
+}
+
+// RefreshWit counts the workitems under the epic. If area is set only the workitems under
+// that area path are counted and they are grouped by the subtrees directly under it. Workitems
+// in progress without a change for more than staleDays need attention.
+func (q *AzureDevopsWit) RefreshWit(parentEpic int, filterSemester bool, area string, staleDays int) (EpicStat, error) {
 
 	epic, err := q.GetWorkitem(parentEpic)
 	if err != nil {
@@ -111,48 +221,325 @@ func (q *AzureDevopsWit) RefreshWit(parentEpic int, filterSemester bool) (EpicSt
 	}
 
 	wits, err := q.loadWorkitems(parentEpic)
-	epicStat := EpicStat{epic, 0, 0, 0, 0}
+	epicStat := EpicStat{Epic: epic}
 	if err != nil {
 		return epicStat, err
 	}
 
-	now := time.Now()
-	month := now.Month()
-	if month < 7 {
-		month = time.January // First semester
-	} else {
-		month = time.July // Second semester
-	}
+	tags := make(map[string]*GroupStat)
+	areas := make(map[string]*GroupStat)
 
-	// Starttime of the current semester
-	semesterStart := time.Date(now.Year(), month, 1, 0, 0, 0, 0, time.Local)
+	now := time.Now()
+	start := semesterStart(now)
 
 	for _, w := range wits {
 		if w.Type == "Epic" { // don't count the epics
 			continue
 		}
 
-		if filterSemester && (w.State == "Done" || w.State == "Removed") &&
-			w.ChangedDate.Before(semesterStart) {
+		if filterSemester && stateBucket(w.State) == StateDone &&
+			w.ChangedDate.Before(start) {
 			continue
 		}
 
-		switch w.State {
-		case "New", "To Do", "Committed":
+		if !inAreaPath(w.AreaPath, area) {
+			continue
+		}
+
+		if len(w.Tags) == 0 {
+			addGroupStat(tags, "Untagged", w.State)
+		}
+		for _, tag := range w.Tags {
+			addGroupStat(tags, tag, w.State)
+		}
+		addGroupStat(areas, areaGroup(w.AreaPath, area), w.State)
+
+		if reasons := needsAttention(w, staleDays, now); len(reasons) > 0 {
+			epicStat.Attention = append(epicStat.Attention, AttentionItem{w, reasons})
+		}
+
+		points := w.Points()
+		switch stateBucket(w.State) {
+		case StateNotDone:
 			epicStat.NotDone++
-		case "In Progress":
+			epicStat.NotDonePoints += points
+			epicStat.RemainingWork += w.RemainingWork
+		case StateInProgress:
 			epicStat.InProgress++
-		case "Done", "Removed":
+			epicStat.InProgressPoints += points
+			epicStat.RemainingWork += w.RemainingWork
+		case StateDone:
 			epicStat.Done++
+			epicStat.DonePoints += points
 		default:
 			epicStat.Unknown++
+			epicStat.UnknownPoints += points
 		}
 
 	}
+
+	epicStat.Tags = sortGroupStats(tags)
+	epicStat.Areas = sortGroupStats(areas)
 	return epicStat, nil
 }
 
+// addGroupStat counts the state of a workitem in the named group
+func addGroupStat(groups map[string]*GroupStat, name, state string) {
+	g, ok := groups[name]
+	if !ok {
+		g = &GroupStat{Name: name}
+		groups[name] = g
+	}
+
+	switch stateBucket(state) {
+	case StateNotDone:
+		g.NotDone++
+	case StateInProgress:
+		g.InProgress++
+	case StateDone:
+		g.Done++
+	default:
+		g.Unknown++
+	}
+}
+
+// mergeGroupStats adds up the groups picked by groupsOf from all the epics
+func mergeGroupStats(epicStats []EpicStat, groupsOf func(EpicStat) []GroupStat) []GroupStat {
+	groups := make(map[string]*GroupStat)
+	for _, e := range epicStats {
+		for _, eg := range groupsOf(e) {
+			g, ok := groups[eg.Name]
+			if !ok {
+				g = &GroupStat{Name: eg.Name}
+				groups[eg.Name] = g
+			}
+
+			g.Done += eg.Done
+			g.NotDone += eg.NotDone
+			g.InProgress += eg.InProgress
+			g.Unknown += eg.Unknown
+		}
+	}
+
+	return sortGroupStats(groups)
+}
+
+func sortGroupStats(groups map[string]*GroupStat) []GroupStat {
+	var stats []GroupStat
+	for _, g := range groups {
+		stats = append(stats, *g)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
+// needsAttention returns why a workitem that is not done looks stuck, if it does
+func needsAttention(w WorkItem, staleDays int, now time.Time) []string {
+	bucket := stateBucket(w.State)
+	if bucket == StateDone {
+		return nil
+	}
+
+	var reasons []string
+	if w.Blocked || w.State == "Blocked" {
+		reasons = append(reasons, "blocked")
+	} else {
+		for _, tag := range w.Tags {
+			if strings.EqualFold(tag, "Blocked") {
+				reasons = append(reasons, "blocked")
+				break
+			}
+		}
+	}
+
+	if bucket == StateInProgress && now.Sub(w.ChangedDate) > time.Duration(staleDays)*24*time.Hour {
+		reasons = append(reasons, fmt.Sprintf("no change for %v days", int(now.Sub(w.ChangedDate).Hours()/24)))
+	}
+
+	if len(w.AssignedTo) == 0 {
+		reasons = append(reasons, "unassigned")
+	}
+
+	return reasons
+}
+
+// inAreaPath checks if path is area or somewhere under it
+func inAreaPath(path, area string) bool {
+	return len(area) == 0 || strings.EqualFold(path, area) ||
+		strings.HasPrefix(strings.ToLower(path), strings.ToLower(area)+`\`)
+}
+
+// areaGroup returns the subtree directly under area that path belongs to, or path itself
+// when there is no area to group under
+func areaGroup(path, area string) string {
+	if len(area) == 0 || len(path) <= len(area) {
+		return path
+	}
+
+	rest := path[len(area)+1:]
+	if i := strings.Index(rest, `\`); i >= 0 {
+		rest = rest[:i]
+	}
+
+	return path[:len(area)+1] + rest
+}
+
+// splitTags splits the "tag1; tag2" format of System.Tags
+func splitTags(tags string) []string {
+	var names []string
+	for _, t := range strings.Split(tags, ";") {
+		t = strings.TrimSpace(t)
+		if len(t) != 0 {
+			names = append(names, t)
+		}
+	}
+
+	return names
+}
+
+// getAssigneeStats counts the state buckets of the workitems per assignee, ordered by name
+func getAssigneeStats(items []WorkItem) []AssigneeStat {
+	assignees := make(map[string]*AssigneeStat)
+	for _, wi := range items {
+		name := wi.AssignedTo
+		if len(name) == 0 {
+			name = "Unassigned"
+		}
+
+		a, ok := assignees[name]
+		if !ok {
+			a = &AssigneeStat{Name: name}
+			assignees[name] = a
+		}
+
+		switch stateBucket(wi.State) {
+		case StateNotDone:
+			a.NotDone++
+		case StateInProgress:
+			a.InProgress++
+		case StateDone:
+			a.Done++
+		default:
+			a.Unknown++
+		}
+	}
+
+	var stats []AssigneeStat
+	for _, a := range assignees {
+		stats = append(stats, *a)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats
+}
+
+func bucketName(bucket int) string {
+	switch bucket {
+	case StateNotDone:
+		return "To Do"
+	case StateInProgress:
+		return "In Progress"
+	case StateDone:
+		return "Done"
+	default:
+		return "Unknown"
+	}
+}
+
+// Buckets returns the done, in progress, not done and unknown buckets either as
+// workitem counts or weighted by story points
+func (e EpicStat) Buckets(weighted bool) (float64, float64, float64, float64) {
+	if weighted {
+		return e.DonePoints, e.InProgressPoints, e.NotDonePoints, e.UnknownPoints
+	}
+	return float64(e.Done), float64(e.InProgress), float64(e.NotDone), float64(e.Unknown)
+}
+
+// Points returns the story points of the workitem. Scrum process workitems do not have
+// story points but effort, so fallback to that.
+func (w WorkItem) Points() float64 {
+	if w.StoryPoints > 0 {
+		return w.StoryPoints
+	}
+	return w.Effort
+}
+
+// stateBuckets maps the workitem states to the buckets, states can be added in the config
+var stateBuckets = map[string]int{
+	"New":         StateNotDone,
+	"To Do":       StateNotDone,
+	"Committed":   StateNotDone,
+	"In Progress": StateInProgress,
+	"Done":        StateDone,
+	"Closed":      StateDone,
+	"Removed":     StateDone,
+}
+
+// stateBucket maps a workitem state onto one of the buckets we report on
+func stateBucket(state string) int {
+	if bucket, ok := stateBuckets[state]; ok {
+		return bucket
+	}
+	return StateUnknown
+}
+
+// bucketStates returns the states in the bucket as a WIQL list like ('Done', 'Removed')
+func bucketStates(bucket int) string {
+	var states []string
+	for state, b := range stateBuckets {
+		if b == bucket {
+			states = append(states, "'"+strings.Replace(state, "'", "''", -1)+"'")
+		}
+	}
+	sort.Strings(states)
+
+	return "(" + strings.Join(states, ", ") + ")"
+}
+
 func (r *AzureDevopsWit) loadWorkitems(parentEpic int) ([]WorkItem, error) {
+	ids, err := r.loadWorkitemIds(parentEpic)
+	if err != nil {
+		return nil, err
+	}
+
+	var workItems []WorkItem
+
+	for _, id := range ids {
+		wi, err := r.GetWorkitem(id)
+		if err != nil {
+			return nil, err
+		}
+
+		workItems = append(workItems, wi)
+	}
+
+	return workItems, nil
+}
+
+// loadWorkitemIds returns the ids of all the workitems under parentEpic (including itself)
+func (r *AzureDevopsWit) loadWorkitemIds(parentEpic int) ([]int, error) {
+	links, err := r.loadWorkitemLinks(parentEpic)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, w := range links {
+		ids = append(ids, w.Target.Id)
+	}
+
+	return ids, nil
+}
+
+// loadWorkitemLinks returns the parent-child links of the tree of workitems under parentEpic
+func (r *AzureDevopsWit) loadWorkitemLinks(parentEpic int) ([]WorkItemRelations, error) {
 	// https://docs.microsoft.com/en-us/rest/api/azure/devops/wit/wiql/query%20by%20id?view=azure-devops-rest-4.1
 	URL := "_apis/wit/wiql?api-version=4.1"
 
@@ -164,7 +551,12 @@ func (r *AzureDevopsWit) loadWorkitems(parentEpic int) ([]WorkItem, error) {
     [System.AssignedTo],
     [System.State],
 	[System.Tags],
-	[System.ChangedDate]
+	[System.AreaPath],
+	[System.IterationPath],
+	[System.ChangedDate],
+	[Microsoft.VSTS.Scheduling.StoryPoints],
+	[Microsoft.VSTS.Scheduling.Effort],
+	[Microsoft.VSTS.Scheduling.RemainingWork]
 	FROM workitemLinks
 	WHERE
 		(
@@ -197,18 +589,7 @@ func (r *AzureDevopsWit) loadWorkitems(parentEpic int) ([]WorkItem, error) {
 		return nil, err
 	}
 
-	var workItems []WorkItem
-
-	for _, w := range response.WitRelations {
-		wi, err := r.GetWorkitem(w.Target.Id)
-		if err != nil {
-			return nil, err
-		}
-
-		workItems = append(workItems, wi)
-	}
-
-	return workItems, nil
+	return response.WitRelations, nil
 }
 
 func (r *AzureDevopsWit) GetWorkitem(witId int) (WorkItem, error) {
@@ -225,6 +606,24 @@ func (r *AzureDevopsWit) GetWorkitem(witId int) (WorkItem, error) {
 		return WorkItem{}, err
 	}
 
-	t, _ := time.Parse(time.RFC3339, wi.WitFields.ChangedDate)
-	return WorkItem{wi.Id, wi.WitFields.State, wi.WitFields.Type, wi.WitFields.Title, wi.WitFields.AssignedTo, t}, nil
+	return toWorkItem(wi.Id, wi.WitFields), nil
+}
+
+func toWorkItem(id int, f Fields) WorkItem {
+	t, _ := time.Parse(time.RFC3339, f.ChangedDate)
+	return WorkItem{
+		Id:            id,
+		State:         f.State,
+		Type:          f.Type,
+		Title:         f.Title,
+		AssignedTo:    f.AssignedTo,
+		ChangedDate:   t,
+		AreaPath:      f.AreaPath,
+		IterationPath: f.IterationPath,
+		Tags:          splitTags(f.Tags),
+		Blocked:       f.Blocked == "Yes",
+		StoryPoints:   f.StoryPoints,
+		Effort:        f.Effort,
+		RemainingWork: f.RemainingWork,
+	}
 }